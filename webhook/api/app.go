@@ -2,18 +2,81 @@ package api
 
 import (
 	"context"
-	"k8s-update-deployment-ecr-tag/webhook/api/handler"
+	"crypto/x509"
+	"k8s-update-deployment-ecr-tag/webhook/api/audit"
+	"k8s-update-deployment-ecr-tag/webhook/api/config"
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/function"
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/tagpolicy"
 	"net/http"
+	"time"
 )
 
 type App struct {
+	Config   *config.Config
+	Policies config.PolicySource
+	Handler  function.Handler
+	// Certificate is the leaf of the TLS certificate served; nil until it is loaded.
+	Certificate *x509.Certificate
+	// Credentials, when set, returns an error while the AWS credentials cannot be retrieved.
+	Credentials func(context.Context) error
+	// Ready, when set, returns an error until the cache is warm.
+	Ready func() error
+	// Audit, when set, is the trail of the decisions queried on GET /audit.
+	Audit *audit.Store
+}
+
+// NewApp creates a new App serving admissions with the handler.
+func NewApp(cfg *config.Config, policies config.PolicySource, handler function.Handler) *App {
+	return &App{
+		Config:   cfg,
+		Policies: policies,
+		Handler:  handler,
+	}
 }
 
 func (app *App) HandleMutate(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
-	respAdmissionReview, error := handler.Handler(ctx, r)
+	serveAdmission(w, r, app.Handler, app.Config.Server)
+}
+
+// HandleValidateTagPolicy admits TagPolicy resources whose spec is valid.
+func (app *App) HandleValidateTagPolicy(w http.ResponseWriter, r *http.Request) {
+	serveAdmission(w, r, function.Handler(tagpolicy.Validate).WithLogging(), app.Config.Server)
+}
+
+// serveAdmission responds to the admission request with the review of the handler.
+// The handler's context is cancelled the headroom before the API server gives up on
+// the admission, leaving the webhook time to answer with its fail mode.
+func serveAdmission(w http.ResponseWriter, r *http.Request, handler function.Handler, cfg config.Server) {
+	ctx, cancel := context.WithTimeout(r.Context(), admissionBudget(admissionTimeout(r, cfg.AdmissionTimeout.Duration), cfg.TimeoutHeadroom.Duration))
+	defer cancel()
+	respAdmissionReview, error := handler(ctx, r)
 	if error != nil {
 		jsonError(w, error.Error(), http.StatusInternalServerError)
+		return
 	}
 	jsonOk(w, &respAdmissionReview)
 }
+
+// admissionTimeout returns the timeout the API server set on the admission request,
+// or the configured one when the request does not carry it.
+func admissionTimeout(r *http.Request, configured time.Duration) time.Duration {
+	if timeout, err := time.ParseDuration(r.URL.Query().Get("timeout")); err == nil && timeout > 0 {
+		return timeout
+	}
+	return configured
+}
+
+// admissionBudget returns the time the handler is given out of the admission's timeout:
+// the timeout less the headroom, but at least half of it, for the AWS calls not to be
+// cancelled before they start when the API server's timeout is shorter than configured.
+func admissionBudget(timeout, headroom time.Duration) time.Duration {
+	if budget := timeout - headroom; budget > timeout/2 {
+		return budget
+	}
+	return timeout / 2
+}
+
+// HandlePolicy renders the policy currently applied to admissions.
+func (app *App) HandlePolicy(w http.ResponseWriter, r *http.Request) {
+	jsonOk(w, app.Policies.Current())
+}
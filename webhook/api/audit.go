@@ -0,0 +1,83 @@
+package api
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"k8s-update-deployment-ecr-tag/webhook/api/audit"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultAuditLimit is the number of records returned when the query sets no limit.
+const defaultAuditLimit = 100
+
+// Authenticate lets through the requests bearing the token of the audit trail's token file,
+// read on each request for the token to be rotated without restarting the webhook.
+func (app *App) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.Audit == nil {
+			jsonError(w, "audit trail disabled", http.StatusNotFound)
+			return
+		}
+		token, err := os.ReadFile(app.Config.AuditTrail.TokenFile)
+		if err != nil {
+			jsonError(w, "reading the audit token: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		expected := strings.TrimSpace(string(token))
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if expected == "" || subtle.ConstantTimeCompare([]byte(given), []byte(expected)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="audit"`)
+			jsonError(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HandleAudit renders the decisions of the audit trail selected by the namespace, workload,
+// repository, since, until (RFC 3339 times) and limit query parameters, oldest first.
+func (app *App) HandleAudit(w http.ResponseWriter, r *http.Request) {
+	q, err := auditQuery(r)
+	if err != nil {
+		app.HandleError(w, r, err)
+		return
+	}
+	records, err := app.Audit.Query(q)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	jsonOk(w, map[string][]audit.Record{"records": records})
+}
+
+// auditQuery parses the query of the audit trail from the request's parameters.
+func auditQuery(r *http.Request) (audit.Query, error) {
+	params := r.URL.Query()
+	q := audit.Query{
+		Namespace:  params.Get("namespace"),
+		Workload:   params.Get("workload"),
+		Repository: params.Get("repository"),
+		Limit:      defaultAuditLimit,
+	}
+	var err error
+	for _, t := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &q.Since}, {"until", &q.Until}} {
+		if value := params.Get(t.name); value != "" {
+			if *t.t, err = time.Parse(time.RFC3339, value); err != nil {
+				return q, fmt.Errorf("invalid %s %q, expected an RFC 3339 time", t.name, value)
+			}
+		}
+	}
+	if value := params.Get("limit"); value != "" {
+		if q.Limit, err = strconv.Atoi(value); err != nil || q.Limit < 1 {
+			return q, fmt.Errorf("invalid limit %q, expected a positive integer", value)
+		}
+	}
+	return q, nil
+}
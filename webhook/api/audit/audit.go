@@ -0,0 +1,305 @@
+// Package audit keeps an append-only trail of the admissions' decisions in JSON lines
+// files, rotated by size, and queries it.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// current is the name of the file records are appended to.
+	current = "audit.jsonl"
+	// rotatedPrefix starts the names of the rotated files, followed by their rotation time.
+	rotatedPrefix = "audit-"
+	rotatedLayout = "20060102T150405.000000000"
+)
+
+// Record is the decision of an admission, and what it was decided on.
+type Record struct {
+	Time      time.Time `json:"time"`
+	UID       string    `json:"uid"`
+	Namespace string    `json:"namespace"`
+	// Name is the name of the workload; e.g. the deployment.
+	Name      string `json:"name"`
+	Kind      string `json:"kind"`
+	Operation string `json:"operation"`
+	User      string `json:"user,omitempty"`
+	// Repositories are the ECR repositories of the workload's images.
+	Repositories []string          `json:"repositories,omitempty"`
+	ImagesBefore map[string]string `json:"imagesBefore,omitempty"`
+	ImagesAfter  map[string]string `json:"imagesAfter,omitempty"`
+	TagSource    string            `json:"tagSource,omitempty"`
+	Parameter    string            `json:"parameter,omitempty"`
+	// ParameterVersion is the version of the parameter the tag was read from.
+	ParameterVersion string `json:"parameterVersion,omitempty"`
+	Checks           string `json:"checks,omitempty"`
+	Environment      string `json:"environment,omitempty"`
+	Outcome          string `json:"outcome"`
+	Reason           string `json:"reason,omitempty"`
+	// Action is what the profile chose for the error class of a failure.
+	Action   string   `json:"action,omitempty"`
+	Message  string   `json:"message,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// Query selects records; its zero value selects them all.
+type Query struct {
+	Namespace string
+	// Workload is the name of the workload.
+	Workload   string
+	Repository string
+	// Since and Until bound the time of the records, when set.
+	Since time.Time
+	Until time.Time
+	// Limit keeps the most recent records, when positive.
+	Limit int
+}
+
+// Matches checks that the query selects the record.
+func (q Query) Matches(r Record) bool {
+	if q.Namespace != "" && r.Namespace != q.Namespace {
+		return false
+	}
+	if q.Workload != "" && r.Name != q.Workload {
+		return false
+	}
+	if q.Repository != "" && !contains(r.Repositories, q.Repository) {
+		return false
+	}
+	if !q.Since.IsZero() && r.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && r.Time.After(q.Until) {
+		return false
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Store appends the records to a file of its directory, rotated once it reaches MaxFileSize.
+type Store struct {
+	Dir string
+	// MaxFileSize is the size in bytes beyond which the file is rotated.
+	MaxFileSize int64
+	// MaxFiles is how many rotated files are kept, the oldest being removed; zero keeps them all.
+	MaxFiles int
+	// now returns the current time; e.g. time.Now.
+	now func() time.Time
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewStore creates a Store in the directory, creating it if needed.
+func NewStore(dir string, maxFileSize int64, maxFiles int) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("audit: creating %s: %w", dir, err)
+	}
+	return &Store{Dir: dir, MaxFileSize: maxFileSize, MaxFiles: maxFiles, now: time.Now}, nil
+}
+
+// Append writes the record at the end of the trail, dating it when it has no time.
+func (s *Store) Append(r Record) error {
+	if r.Time.IsZero() {
+		r.Time = s.now().UTC()
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("audit: encoding the record of %s: %w", r.UID, err)
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if s.size > 0 && s.size+int64(len(line)) > s.MaxFileSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("audit: writing the record of %s: %w", r.UID, err)
+	}
+	return nil
+}
+
+// open opens the current file for appending.
+func (s *Store) open() error {
+	file, err := os.OpenFile(filepath.Join(s.Dir, current), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("audit: opening %s: %w", current, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("audit: opening %s: %w", current, err)
+	}
+	s.file, s.size = file, info.Size()
+	return nil
+}
+
+// rotate renames the current file after the current time and opens a new one,
+// removing the oldest rotated files beyond MaxFiles.
+func (s *Store) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return fmt.Errorf("audit: closing %s: %w", current, err)
+	}
+	s.file = nil
+	rotated := rotatedPrefix + s.now().UTC().Format(rotatedLayout) + ".jsonl"
+	if err := os.Rename(filepath.Join(s.Dir, current), filepath.Join(s.Dir, rotated)); err != nil {
+		return fmt.Errorf("audit: rotating %s: %w", current, err)
+	}
+	if s.MaxFiles > 0 {
+		files, err := s.rotated()
+		if err != nil {
+			return err
+		}
+		for len(files) > s.MaxFiles {
+			if err := os.Remove(filepath.Join(s.Dir, files[0])); err != nil {
+				return fmt.Errorf("audit: removing %s: %w", files[0], err)
+			}
+			files = files[1:]
+		}
+	}
+	return s.open()
+}
+
+// rotated returns the names of the rotated files, oldest first.
+func (s *Store) rotated() ([]string, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("audit: listing %s: %w", s.Dir, err)
+	}
+	var files []string
+	for _, entry := range entries {
+		if name := entry.Name(); strings.HasPrefix(name, rotatedPrefix) && strings.HasSuffix(name, ".jsonl") {
+			files = append(files, name)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Query returns the records the query selects, oldest first. The files are only
+// opened with the store locked, so that appends never wait for a query to read them.
+func (s *Store) Query(q Query) ([]Record, error) {
+	files, err := s.openFiles()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, f := range files {
+			f.file.Close()
+		}
+	}()
+
+	records := []Record{}
+	for _, f := range files {
+		matched, err := scan(f, q)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, matched...)
+		if q.Limit > 0 && len(records) > q.Limit {
+			records = records[len(records)-q.Limit:]
+		}
+	}
+	return records, nil
+}
+
+// snapshot is a file of the trail opened by a query, along with its size when opened.
+type snapshot struct {
+	name string
+	file *os.File
+	size int64
+}
+
+// openFiles opens the rotated files, oldest first, then the current one. Their size is
+// taken with the store locked, for a query to never read a record being appended, and
+// the open files are still read once rotated or removed.
+func (s *Store) openFiles() ([]snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names, err := s.rotated()
+	if err != nil {
+		return nil, err
+	}
+	names = append(names, current)
+
+	var files []snapshot
+	for _, name := range names {
+		file, err := os.Open(filepath.Join(s.Dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err == nil {
+			var info os.FileInfo
+			if info, err = file.Stat(); err == nil {
+				files = append(files, snapshot{name: name, file: file, size: info.Size()})
+				continue
+			}
+			file.Close()
+		}
+		for _, f := range files {
+			f.file.Close()
+		}
+		return nil, fmt.Errorf("audit: opening %s: %w", name, err)
+	}
+	return files, nil
+}
+
+// scan returns the records of the file the query selects.
+func scan(f snapshot, q Query) ([]Record, error) {
+	var records []Record
+	scanner := bufio.NewScanner(io.LimitReader(f.file, f.size))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("audit: decoding %s:%d: %w", f.name, line, err)
+		}
+		if q.Matches(r) {
+			records = append(records, r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("audit: reading %s: %w", f.name, err)
+	}
+	return records, nil
+}
+
+// Close closes the current file.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
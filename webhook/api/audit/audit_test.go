@@ -0,0 +1,70 @@
+package audit
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2020, 3, 3, 9, 0, 0, 0, time.UTC)
+	s, err := NewStore(dir, 200, 2)
+	require.NoError(t, err)
+	s.now = func() time.Time { return now }
+
+	records := []Record{
+		{UID: "1", Namespace: "develop", Name: "gmt-backend", Repositories: []string{"gmt-backend"}, Outcome: "patched"},
+		{UID: "2", Namespace: "develop", Name: "gmt-frontend", Repositories: []string{"gmt-frontend"}, Outcome: "patched"},
+		{UID: "3", Namespace: "staging", Name: "gmt-backend", Repositories: []string{"gmt-backend"}, Outcome: "denied"},
+		{UID: "4", Namespace: "develop", Name: "gmt-backend", Repositories: []string{"gmt-backend"}, Outcome: "allowed"},
+		{UID: "5", Namespace: "develop", Name: "gmt-backend", Repositories: []string{"gmt-backend"}, Outcome: "patched"},
+	}
+	for _, r := range records {
+		require.NoError(t, s.Append(r))
+		now = now.Add(24 * time.Hour)
+	}
+	require.NoError(t, s.Close())
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 3, "the oldest rotated files are removed")
+
+	uids := func(q Query) []string {
+		records, err := s.Query(q)
+		require.NoError(t, err)
+		uids := []string{}
+		for _, r := range records {
+			uids = append(uids, r.UID)
+		}
+		return uids
+	}
+	all := uids(Query{})
+	require.Equal(t, "5", all[len(all)-1], "records are returned oldest first")
+	require.NotContains(t, all, "1", "the records of removed files are lost")
+
+	tuesday := time.Date(2020, 3, 6, 0, 0, 0, 0, time.UTC)
+	require.Equal(t, []string{"4"}, uids(Query{Workload: "gmt-backend", Namespace: "develop", Since: tuesday, Until: tuesday.Add(24 * time.Hour)}))
+	require.Equal(t, []string{"3", "4", "5"}, uids(Query{Repository: "gmt-backend"}))
+	require.Equal(t, []string{"5"}, uids(Query{Repository: "gmt-backend", Limit: 1}))
+	require.Empty(t, uids(Query{Namespace: "prod"}))
+}
+
+func TestQuerySnapshot(t *testing.T) {
+	s, err := NewStore(t.TempDir(), 1<<20, 0)
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.Append(Record{UID: "1"}))
+
+	files, err := s.openFiles()
+	require.NoError(t, err)
+	require.NoError(t, s.Append(Record{UID: "2"}), "appends do not wait for the query")
+	require.Len(t, files, 1)
+	records, err := scan(files[0], Query{})
+	require.NoError(t, err)
+	files[0].file.Close()
+	require.Len(t, records, 1, "the records appended once the files are opened are not read")
+	require.Equal(t, "1", records[0].UID)
+}
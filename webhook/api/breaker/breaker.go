@@ -0,0 +1,207 @@
+// Package breaker trips the calls to an AWS service after consecutive failures, failing
+// them fast until the service had time to recover, rather than waiting on each call.
+package breaker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"k8s-update-deployment-ecr-tag/webhook/api/metrics"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrCodeOpen is the code of the error failing the calls of an open breaker.
+const ErrCodeOpen = "CircuitBreakerOpen"
+
+// Key identifies the service a breaker guards: an AWS service in a region and,
+// for ECR, the account of the registry; the account is empty for SSM.
+type Key struct {
+	Service string
+	Region  string
+	Account string
+}
+
+// String describes the service of the key; e.g. ecr of 111122223333 in eu-west-3.
+func (k Key) String() string {
+	if k.Account == "" {
+		return k.Service + " in " + k.Region
+	}
+	return k.Service + " of " + k.Account + " in " + k.Region
+}
+
+// Breaker opens after consecutive failed calls to its service, failing the calls
+// until the cooldown elapsed. A single trial call is then let through: its success
+// closes the breaker, its failure opens it for another cooldown.
+type Breaker struct {
+	key      Key
+	failures int
+	cooldown time.Duration
+	// now returns the current time; e.g. time.Now.
+	now func() time.Time
+
+	mu          sync.Mutex
+	consecutive int
+	open        bool
+	openedAt    time.Time
+	trial       bool
+}
+
+// New creates a closed Breaker opening after the consecutive failures.
+func New(key Key, failures int, cooldown time.Duration) *Breaker {
+	return &Breaker{key: key, failures: failures, cooldown: cooldown, now: time.Now}
+}
+
+// Allow returns an error when the call must fail fast.
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return nil
+	}
+	if b.trial || b.now().Sub(b.openedAt) < b.cooldown {
+		return awserr.New(ErrCodeOpen, fmt.Sprintf("%s is unavailable, failing fast until %s", b.key, b.openedAt.Add(b.cooldown).Format(time.RFC3339)), nil)
+	}
+	b.trial = true
+	return nil
+}
+
+// Release ends a call the breaker allowed without counting it, e.g. a call cancelled
+// by its caller; when it was the trial call, the next call is let through instead.
+func (b *Breaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
+
+// Record counts the outcome of a call the breaker allowed.
+func (b *Breaker) Record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if !failed {
+		if b.open {
+			log.Infof("Closing the circuit breaker of %s", b.key)
+			metrics.SetBreakerOpen(b.key.Service, b.key.Region, b.key.Account, false)
+		}
+		b.consecutive, b.open = 0, false
+		return
+	}
+	b.consecutive++
+	if b.open || b.consecutive >= b.failures {
+		if !b.open {
+			log.Warnf("Opening the circuit breaker of %s after %d consecutive failures", b.key, b.consecutive)
+			metrics.SetBreakerOpen(b.key.Service, b.key.Region, b.key.Account, true)
+		}
+		b.open, b.openedAt = true, b.now()
+	}
+}
+
+// Breakers holds a Breaker per AWS service, region and account.
+type Breakers struct {
+	failures int
+	cooldown time.Duration
+
+	mu       sync.Mutex
+	breakers map[Key]*Breaker
+}
+
+// NewBreakers creates the breakers of the services, opening after the consecutive failures.
+func NewBreakers(failures int, cooldown time.Duration) *Breakers {
+	return &Breakers{failures: failures, cooldown: cooldown, breakers: make(map[Key]*Breaker)}
+}
+
+// For returns the breaker of the key, creating it on first use.
+func (b *Breakers) For(key Key) *Breaker {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if breaker, ok := b.breakers[key]; ok {
+		return breaker
+	}
+	breaker := New(key, b.failures, b.cooldown)
+	b.breakers[key] = breaker
+	return breaker
+}
+
+// Install guards the requests sent with the handlers, typically those of a session,
+// with the breaker of their service, region and account. A request counts as failed,
+// once retried, when throttled, answered with a server error or not answered; a
+// request cancelled by its caller or rejected before being sent does not count, but
+// one expiring the deadline of a Bounded context does.
+func (b *Breakers) Install(handlers *request.Handlers) {
+	handlers.Validate.PushFrontNamed(request.NamedHandler{Name: "breaker.Allow", Fn: func(r *request.Request) {
+		if err := b.For(keyOf(r)).Allow(); err != nil {
+			r.Error = err
+		}
+	}})
+	handlers.Complete.PushBackNamed(request.NamedHandler{Name: "breaker.Record", Fn: func(r *request.Request) {
+		if aerr, ok := r.Error.(awserr.Error); ok && aerr.Code() == ErrCodeOpen {
+			return
+		}
+		if failed, counted := outcome(r); counted {
+			b.For(keyOf(r)).Record(failed)
+		} else {
+			b.For(keyOf(r)).Release()
+		}
+	}})
+}
+
+// bounded is the key of the contexts marked by Bounded.
+type bounded struct{}
+
+// Bounded marks the deadline of the context as the one of the calls sent with it, rather
+// than the one of their caller; e.g. a cache load outliving its caller, with a timeout of
+// its own. The calls expiring it failed, the service being too slow, and are counted.
+func Bounded(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bounded{}, true)
+}
+
+// keyOf returns the key of the request: its service, its region and, for ECR,
+// the registry it is sent to, from the RegistryId of its input.
+func keyOf(r *request.Request) Key {
+	key := Key{Service: r.ClientInfo.ServiceName, Region: aws.StringValue(r.Config.Region)}
+	if v := reflect.ValueOf(r.Params); v.Kind() == reflect.Ptr && !v.IsNil() && v.Elem().Kind() == reflect.Struct {
+		if f := v.Elem().FieldByName("RegistryId"); f.IsValid() {
+			if id, ok := f.Interface().(*string); ok {
+				key.Account = aws.StringValue(id)
+			}
+		}
+	}
+	return key
+}
+
+// outcome returns whether the request failed for its service being unavailable, rather
+// than for the request itself, e.g. a missing parameter; and whether it is counted at all.
+// Requests cancelled by their caller, or failing before being sent, say them invalid or
+// unsigned, tell nothing about the service and are not counted; those expiring the deadline
+// of a Bounded context are.
+func outcome(r *request.Request) (failed, counted bool) {
+	if r.Error == nil {
+		return false, true
+	}
+	if ctx := r.Context(); ctx.Value(bounded{}) != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return true, true
+	}
+	if aerr, ok := r.Error.(awserr.Error); ok {
+		switch aerr.Code() {
+		case request.CanceledErrorCode:
+			return false, false
+		case request.ErrCodeRequestError, request.ErrCodeResponseTimeout:
+			cancelled := errors.Is(aerr.OrigErr(), context.Canceled) || errors.Is(aerr.OrigErr(), context.DeadlineExceeded)
+			return !cancelled, !cancelled
+		}
+	}
+	if r.IsErrorThrottle() {
+		return true, true
+	}
+	if r.HTTPResponse == nil {
+		return false, false
+	}
+	return r.HTTPResponse.StatusCode >= 500, true
+}
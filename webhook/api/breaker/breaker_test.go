@@ -0,0 +1,217 @@
+package breaker
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Date(2020, 3, 7, 5, 30, 0, 0, time.UTC)
+	b := New(Key{Service: "ssm", Region: "eu-west-3"}, 2, time.Minute)
+	b.now = func() time.Time { return now }
+
+	require.NoError(t, b.Allow())
+	b.Record(true)
+	require.NoError(t, b.Allow(), "a single failure keeps the breaker closed")
+	b.Record(false)
+	b.Record(true)
+	require.NoError(t, b.Allow(), "a success resets the consecutive failures")
+	b.Record(true)
+	require.Error(t, b.Allow(), "consecutive failures open the breaker")
+
+	now = now.Add(time.Minute)
+	require.NoError(t, b.Allow(), "a trial call is let through after the cooldown")
+	require.Error(t, b.Allow(), "only one trial call is let through")
+	b.Record(true)
+	require.Error(t, b.Allow(), "a failed trial opens the breaker again")
+
+	now = now.Add(time.Minute)
+	require.NoError(t, b.Allow())
+	b.Record(false)
+	require.NoError(t, b.Allow(), "a successful trial closes the breaker")
+	require.NoError(t, b.Allow())
+}
+
+func TestInstall(t *testing.T) {
+	var calls int32
+	status := http.StatusInternalServerError
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.WriteHeader(status)
+		if status == http.StatusBadRequest {
+			w.Write([]byte(`{"__type":"ParameterNotFound","message":"not found"}`))
+			return
+		}
+		w.Write([]byte(`{"__type":"InternalServerError","message":"unavailable"}`))
+	}))
+	defer server.Close()
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:    aws.String(server.URL),
+		Region:      aws.String("eu-west-3"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	}))
+	NewBreakers(2, time.Minute).Install(&sess.Handlers)
+	svc := ssm.New(sess)
+	input := &ssm.GetParameterInput{Name: aws.String("/gmt/backend/ecr_tag")}
+
+	status = http.StatusBadRequest
+	for i := 0; i < 3; i++ {
+		_, err := svc.GetParameter(input)
+		require.Error(t, err)
+	}
+	require.Equal(t, int32(3), atomic.LoadInt32(&calls), "client errors do not open the breaker")
+
+	status = http.StatusInternalServerError
+	for i := 0; i < 2; i++ {
+		_, err := svc.GetParameter(input)
+		require.Error(t, err)
+	}
+	_, err := svc.GetParameter(input)
+	require.Error(t, err)
+	require.Equal(t, ErrCodeOpen, err.(awserr.Error).Code())
+	require.Equal(t, int32(5), atomic.LoadInt32(&calls), "calls fail fast once the breaker is open")
+
+	_, err = ssm.New(sess, &aws.Config{Region: aws.String("us-east-1")}).GetParameter(input)
+	require.Error(t, err)
+	require.Equal(t, int32(6), atomic.LoadInt32(&calls), "the breakers of other regions stay closed")
+}
+
+func TestInstallIgnoresCancelledRequests(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			time.Sleep(100 * time.Millisecond)
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.Write([]byte(`{"Parameter":{"Name":"/gmt/backend/ecr_tag","Value":"5d1a9c2"}}`))
+	}))
+	defer server.Close()
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:    aws.String(server.URL),
+		Region:      aws.String("eu-west-3"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	}))
+	NewBreakers(1, time.Minute).Install(&sess.Handlers)
+	svc := ssm.New(sess)
+
+	_, err := svc.GetParameter(&ssm.GetParameterInput{})
+	require.Error(t, err, "the input is invalid")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = svc.GetParameterWithContext(ctx, &ssm.GetParameterInput{Name: aws.String("/gmt/backend/ecr_tag")})
+	require.Error(t, err)
+	require.Equal(t, request.CanceledErrorCode, err.(awserr.Error).Code())
+
+	_, err = svc.GetParameter(&ssm.GetParameterInput{Name: aws.String("/gmt/backend/ecr_tag")})
+	require.NoError(t, err, "neither invalid nor cancelled requests open the breaker")
+	require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestInstallReleasesCancelledTrial(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		switch {
+		case strings.Contains(string(body), "throttled"):
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"ThrottlingException","message":"rate exceeded"}`))
+			return
+		case strings.Contains(string(body), "slow"):
+			time.Sleep(100 * time.Millisecond)
+		}
+		w.Write([]byte(`{"Parameter":{"Name":"/gmt/backend/ecr_tag","Value":"5d1a9c2"}}`))
+	}))
+	defer server.Close()
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:    aws.String(server.URL),
+		Region:      aws.String("eu-west-3"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	}))
+	NewBreakers(1, 10*time.Millisecond).Install(&sess.Handlers)
+	svc := ssm.New(sess)
+
+	_, err := svc.GetParameter(&ssm.GetParameterInput{Name: aws.String("/throttled/ecr_tag")})
+	require.Error(t, err, "the throttled call opens the breaker")
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = svc.GetParameterWithContext(ctx, &ssm.GetParameterInput{Name: aws.String("/slow/ecr_tag")})
+	require.Error(t, err)
+	require.Equal(t, request.CanceledErrorCode, err.(awserr.Error).Code(), "the trial call is cancelled")
+
+	_, err = svc.GetParameter(&ssm.GetParameterInput{Name: aws.String("/gmt/backend/ecr_tag")})
+	require.NoError(t, err, "a cancelled trial lets the next call through")
+}
+
+func TestInstallCountsBoundedDeadline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.Write([]byte(`{"Parameter":{"Name":"/gmt/backend/ecr_tag","Value":"5d1a9c2"}}`))
+	}))
+	defer server.Close()
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:    aws.String(server.URL),
+		Region:      aws.String("eu-west-3"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	}))
+	NewBreakers(1, time.Minute).Install(&sess.Handlers)
+	svc := ssm.New(sess)
+	input := &ssm.GetParameterInput{Name: aws.String("/gmt/backend/ecr_tag")}
+
+	ctx, cancel := context.WithTimeout(Bounded(context.Background()), 10*time.Millisecond)
+	defer cancel()
+	_, err := svc.GetParameterWithContext(ctx, input)
+	require.Error(t, err)
+
+	_, err = svc.GetParameter(input)
+	require.Error(t, err)
+	require.Equal(t, ErrCodeOpen, err.(awserr.Error).Code(), "a call expiring its own deadline opens the breaker")
+}
+
+func TestKeyOf(t *testing.T) {
+	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String("eu-west-3"), Credentials: credentials.AnonymousCredentials}))
+	tests := []struct {
+		name    string
+		request *request.Request
+		want    Key
+	}{
+		{"SSM", func() *request.Request {
+			r, _ := ssm.New(sess).GetParameterRequest(&ssm.GetParameterInput{Name: aws.String("/gmt/backend/ecr_tag")})
+			return r
+		}(), Key{Service: "ssm", Region: "eu-west-3"}},
+		{"ECR", func() *request.Request {
+			r, _ := ecr.New(sess, &aws.Config{Region: aws.String("us-east-1")}).DescribeImagesRequest(&ecr.DescribeImagesInput{RegistryId: aws.String("111122223333")})
+			return r
+		}(), Key{Service: "ecr", Region: "us-east-1", Account: "111122223333"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, keyOf(tt.request))
+		})
+	}
+}
@@ -0,0 +1,161 @@
+// Package cache memoizes the results of AWS lookups for a while, and coalesces
+// concurrent identical lookups into a single call.
+package cache
+
+import (
+	"context"
+	"k8s-update-deployment-ecr-tag/webhook/api/metrics"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Cache holds the results of lookups by key: values for the TTL, and errors the
+// negative function accepts, typically a missing resource, for the negative TTL.
+// Other errors are never cached. A zero TTL disables the cache, lookups still being coalesced.
+type Cache struct {
+	name        string
+	ttl         time.Duration
+	negativeTTL time.Duration
+	// loadTimeout bounds a load, which outlives the callers giving up on it; zero does not.
+	loadTimeout time.Duration
+	negative    func(error) bool
+	// now returns the current time; e.g. time.Now.
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]entry
+	group   singleflight.Group
+}
+
+type entry struct {
+	value interface{}
+	err   error
+	// loaded is when the result was loaded.
+	loaded  time.Time
+	expires time.Time
+}
+
+// loadedValue is the value of a load along with when it was loaded.
+type loadedValue struct {
+	value interface{}
+	at    time.Time
+}
+
+// New creates a Cache, named in its metrics, whose loads time out after the load timeout.
+// negative may be nil to cache no error.
+func New(name string, ttl, negativeTTL, loadTimeout time.Duration, negative func(error) bool) *Cache {
+	return &Cache{
+		name:        name,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		loadTimeout: loadTimeout,
+		negative:    negative,
+		now:         time.Now,
+		entries:     make(map[string]entry),
+	}
+}
+
+// Get returns the result cached for the key, or loads it. Concurrent callers missing
+// the same key share a single load, whose result they all get. The load is given the
+// values of the first caller's context but not its cancellation, so that a caller
+// giving up, with its context's error, does not fail the load of the others.
+func (c *Cache) Get(ctx context.Context, key string, load func(context.Context) (interface{}, error)) (interface{}, error) {
+	value, _, err := c.GetLoaded(ctx, key, load)
+	return value, err
+}
+
+// GetLoaded is Get, also returning when the result was loaded: a while ago when it was cached.
+func (c *Cache) GetLoaded(ctx context.Context, key string, load func(context.Context) (interface{}, error)) (interface{}, time.Time, error) {
+	if e, ok := c.lookup(key); ok {
+		metrics.ObserveCache(c.name, metrics.CacheHit)
+		return e.value, e.loaded, e.err
+	}
+	loaded := false
+	results := c.group.DoChan(key, func() (interface{}, error) {
+		loaded = true
+		ctx, cancel := c.loadContext(ctx)
+		defer cancel()
+		value, err := load(ctx)
+		at := c.now()
+		c.store(key, value, err, at)
+		return loadedValue{value: value, at: at}, err
+	})
+	select {
+	case <-ctx.Done():
+		return nil, time.Time{}, ctx.Err()
+	case result := <-results:
+		if loaded {
+			metrics.ObserveCache(c.name, metrics.CacheMiss)
+		} else {
+			metrics.ObserveCache(c.name, metrics.CacheCoalesced)
+		}
+		l := result.Val.(loadedValue)
+		return l.value, l.at, result.Err
+	}
+}
+
+// loadContext returns the context of a load started by the caller of the context.
+func (c *Cache) loadContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.loadTimeout <= 0 {
+		return context.WithCancel(detached{ctx})
+	}
+	return context.WithTimeout(detached{ctx}, c.loadTimeout)
+}
+
+// detached is a context with the values of its parent, e.g. its span, but never done.
+type detached struct {
+	parent context.Context
+}
+
+func (detached) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detached) Done() <-chan struct{}               { return nil }
+func (detached) Err() error                          { return nil }
+func (d detached) Value(key interface{}) interface{} { return d.parent.Value(key) }
+
+// Set caches the value for the cache's TTL, as if it was loaded, replacing the result
+// cached for the key; e.g. to warm the cache up.
+func (c *Cache) Set(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	c.entries[key] = entry{value: value, loaded: now, expires: now.Add(c.ttl)}
+}
+
+// Invalidate forgets the result cached for the key.
+func (c *Cache) Invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+func (c *Cache) lookup(key string) (entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return entry{}, false
+	}
+	if !c.now().Before(e.expires) {
+		delete(c.entries, key)
+		return entry{}, false
+	}
+	return e, true
+}
+
+func (c *Cache) store(key string, value interface{}, err error, loaded time.Time) {
+	ttl := c.ttl
+	if err != nil {
+		if c.negative == nil || !c.negative(err) {
+			return
+		}
+		ttl = c.negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = entry{value: value, err: err, loaded: loaded, expires: loaded.Add(ttl)}
+}
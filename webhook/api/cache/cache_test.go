@@ -0,0 +1,112 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var errNotFound = errors.New("not found")
+
+func TestGet(t *testing.T) {
+	now := time.Date(2020, 3, 7, 5, 30, 0, 0, time.UTC)
+	c := New("test", time.Minute, 10*time.Second, 0, func(err error) bool { return errors.Is(err, errNotFound) })
+	c.now = func() time.Time { return now }
+
+	var loads int
+	load := func(value interface{}, err error) func(context.Context) (interface{}, error) {
+		return func(context.Context) (interface{}, error) {
+			loads++
+			return value, err
+		}
+	}
+
+	value, err := c.Get(context.Background(), "tag", load("5d1a9c2", nil))
+	require.NoError(t, err)
+	require.Equal(t, "5d1a9c2", value)
+	value, _ = c.Get(context.Background(), "tag", load("bec0e8f", nil))
+	require.Equal(t, "5d1a9c2", value, "the value is cached for the TTL")
+	now = now.Add(time.Minute)
+	value, _ = c.Get(context.Background(), "tag", load("bec0e8f", nil))
+	require.Equal(t, "bec0e8f", value, "the value expired")
+	require.Equal(t, 2, loads)
+
+	_, err = c.Get(context.Background(), "missing", load(nil, errNotFound))
+	require.Equal(t, errNotFound, err)
+	_, err = c.Get(context.Background(), "missing", load("created", nil))
+	require.Equal(t, errNotFound, err, "missing resources are cached for the negative TTL")
+	now = now.Add(10 * time.Second)
+	value, _ = c.Get(context.Background(), "missing", load("created", nil))
+	require.Equal(t, "created", value)
+
+	_, err = c.Get(context.Background(), "throttled", load(nil, errors.New("rate exceeded")))
+	require.Error(t, err)
+	value, _ = c.Get(context.Background(), "throttled", load("5d1a9c2", nil))
+	require.Equal(t, "5d1a9c2", value, "other errors are not cached")
+}
+
+func TestGetCoalesces(t *testing.T) {
+	c := New("test", 0, 0, 0, nil)
+	var loads int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := c.Get(context.Background(), "tag", func(context.Context) (interface{}, error) {
+				atomic.AddInt32(&loads, 1)
+				<-release
+				return "5d1a9c2", nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, "5d1a9c2", value)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	require.Less(t, atomic.LoadInt32(&loads), int32(10), "concurrent lookups share a load")
+}
+
+func TestGetOutlivesCaller(t *testing.T) {
+	c := New("test", time.Minute, 0, time.Second, nil)
+	started, release := make(chan struct{}), make(chan struct{})
+	load := func(ctx context.Context) (interface{}, error) {
+		close(started)
+		select {
+		case <-release:
+			return "5d1a9c2", nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		_, err := c.Get(ctx, "tag", load)
+		first <- err
+	}()
+	<-started
+	second := make(chan interface{})
+	go func() {
+		value, _ := c.Get(context.Background(), "tag", load)
+		second <- value
+	}()
+	cancel()
+	require.Equal(t, context.Canceled, <-first, "the caller giving up gets its context's error")
+	close(release)
+	require.Equal(t, "5d1a9c2", <-second, "the load is not cancelled with its first caller")
+
+	_, err := New("test", time.Minute, 0, 10*time.Millisecond, nil).Get(context.Background(), "tag", func(ctx context.Context) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	require.Equal(t, context.DeadlineExceeded, err, "loads time out")
+}
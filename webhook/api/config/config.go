@@ -0,0 +1,644 @@
+// Package config contains the typed configuration of the webhook.
+// The configuration is read from an optional YAML file, then overridden
+// by environment variables and finally by command line flags.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the configuration of the webhook.
+type Config struct {
+	Server      Server      `json:"server"`
+	Log         Log         `json:"log"`
+	AWS         AWS         `json:"aws"`
+	Replication Replication `json:"replication"`
+	PullThrough PullThrough `json:"pullThrough"`
+	// Policy is used as is unless PolicyFile is set, in which case
+	// the policy is read from that file and reloaded when it changes.
+	Policy
+	PolicyFile           string          `json:"policyFile"`
+	PolicyReloadInterval metav1.Duration `json:"policyReloadInterval"`
+	// TagPolicies watches the TagPolicy resources through which namespaces
+	// override their profile; their CustomResourceDefinition must be installed.
+	TagPolicies bool  `json:"tagPolicies"`
+	Cache       Cache `json:"cache"`
+	// LastKnownTags configures the tags served by the lastKnownTag failure action.
+	LastKnownTags LastKnownTags `json:"lastKnownTags"`
+	Warmup        Warmup        `json:"warmup"`
+	Tracing       Tracing       `json:"tracing"`
+	AuditTrail    AuditTrail    `json:"auditTrail"`
+}
+
+// AuditTrail configures the trail of the admissions' decisions, queried on GET /audit.
+type AuditTrail struct {
+	// Dir is the directory of the trail's files; the trail is disabled when empty.
+	Dir string `json:"dir,omitempty"`
+	// MaxFileSize is the size in bytes beyond which the current file is rotated.
+	MaxFileSize int64 `json:"maxFileSize"`
+	// MaxFiles is how many rotated files are kept; zero keeps them all.
+	MaxFiles int `json:"maxFiles"`
+	// TokenFile holds the bearer token authenticating the queries of the trail.
+	TokenFile string `json:"tokenFile,omitempty"`
+}
+
+// Tracing configures the export of the admissions' traces over OTLP.
+type Tracing struct {
+	// Endpoint is the host:port of the OTLP HTTP collector; tracing is disabled when empty.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Insecure exports the traces over plain HTTP.
+	Insecure bool `json:"insecure"`
+	// SampleRatio is the ratio of the admissions traced, unless their caller sampled them.
+	SampleRatio float64 `json:"sampleRatio"`
+}
+
+// Warmup configures the loading of the tag parameters into the SSM cache ahead of admissions.
+type Warmup struct {
+	// Paths are the SSM hierarchies of the default region whose tag parameters
+	// are loaded; e.g. /gmt. The warm-up is disabled when empty.
+	Paths []string `json:"paths,omitempty"`
+	// Interval is how often the tag parameters are loaded again.
+	Interval metav1.Duration `json:"interval"`
+}
+
+// LastKnownTags configures the tags last resolved for each parameter, served when
+// resolving fails and the profile's action is lastKnownTag.
+type LastKnownTags struct {
+	// MaxStaleness is the age beyond which a tag is no longer served; zero serves tags of any age.
+	MaxStaleness metav1.Duration `json:"maxStaleness"`
+	// SnapshotFile, when set, persists the tags to the file for them to survive restarts.
+	SnapshotFile string `json:"snapshotFile,omitempty"`
+	// SnapshotConfigMap, when set, persists the tags to the ConfigMap namespace/name instead.
+	SnapshotConfigMap string `json:"snapshotConfigMap,omitempty"`
+	// SnapshotInterval is how often the tags are persisted when they changed.
+	SnapshotInterval metav1.Duration `json:"snapshotInterval"`
+}
+
+// ConfigMap returns the namespace and name of the snapshot ConfigMap.
+func (l LastKnownTags) ConfigMap() (namespace, name string, err error) {
+	segments := strings.Split(l.SnapshotConfigMap, "/")
+	if len(segments) != 2 || segments[0] == "" || segments[1] == "" {
+		return "", "", fmt.Errorf("expected namespace/name, got %q", l.SnapshotConfigMap)
+	}
+	return segments[0], segments[1], nil
+}
+
+// Cache configures the caching of the AWS lookups. A zero TTL disables the cache.
+type Cache struct {
+	// ECRTTL is how long the repositories and images described are cached.
+	ECRTTL metav1.Duration `json:"ecrTTL"`
+	// SSMTTL is how long the parameters read are cached; a tag updated
+	// in its parameter is only resolved once the previous one expires.
+	SSMTTL metav1.Duration `json:"ssmTTL"`
+	// NegativeTTL is how long missing repositories, images and parameters are cached.
+	NegativeTTL metav1.Duration `json:"negativeTTL"`
+}
+
+// Server configures the admission listener.
+type Server struct {
+	Port    int    `json:"port"`
+	TLSCert string `json:"tlsCert"`
+	TLSKey  string `json:"tlsKey"`
+	// AdminPort is the port of the plain HTTP listener serving the metrics, apart from the admissions.
+	AdminPort int `json:"adminPort"`
+	// AdmissionTimeout is the timeoutSeconds of the webhook configurations, the
+	// timeout of the admissions whose request does not carry the API server's.
+	AdmissionTimeout metav1.Duration `json:"admissionTimeout"`
+	// TimeoutHeadroom is kept from the API server's timeout of an admission
+	// for the webhook to answer it once its AWS calls are cancelled.
+	TimeoutHeadroom metav1.Duration `json:"timeoutHeadroom"`
+}
+
+// MaxAdmissionTimeout is the longest timeoutSeconds of an admission webhook.
+const MaxAdmissionTimeout = 30 * time.Second
+
+// Log formats of the logger.
+const (
+	LogFormatJSON = "json"
+	LogFormatText = "text"
+)
+
+// Log configures the logger.
+type Log struct {
+	Level string `json:"level"`
+	// Format is json or text.
+	Format string `json:"format"`
+	// DecisionSampleRatio is the ratio of the allowed admissions whose decision
+	// is logged; the decisions denying admissions always are.
+	DecisionSampleRatio float64 `json:"decisionSampleRatio"`
+}
+
+// AWS configures the AWS clients.
+type AWS struct {
+	// Region is the default region of the ECR and SSM clients.
+	Region string `json:"region"`
+	// AccountRoles maps a registry account ID to the role assumed to reach it.
+	AccountRoles map[string]string `json:"accountRoles,omitempty"`
+	// SSMRegionFromImage reads parameters from the region of the image's registry.
+	SSMRegionFromImage bool `json:"ssmRegionFromImage"`
+	// MaxRetries is how many times a throttled or failed AWS call is retried, with jittered backoff.
+	MaxRetries     int            `json:"maxRetries"`
+	CircuitBreaker CircuitBreaker `json:"circuitBreaker"`
+}
+
+// CircuitBreaker configures the failing fast of the calls to an AWS service
+// that keeps failing, handled as the awsUnavailable failure of the profile.
+type CircuitBreaker struct {
+	// Failures is how many consecutive failed calls open the breaker; zero disables it.
+	Failures int `json:"failures"`
+	// Cooldown is how long calls fail fast before one is tried again.
+	Cooldown metav1.Duration `json:"cooldown"`
+}
+
+// Replication configures the rewriting of images to registry replicas.
+type Replication struct {
+	Region     string            `json:"region"`
+	Registries map[string]string `json:"registries,omitempty"`
+}
+
+// Enabled reports whether images are rewritten to registry replicas.
+func (r Replication) Enabled() bool {
+	return r.Region != "" || len(r.Registries) > 0
+}
+
+// PullThrough configures the rewriting of public images to ECR pull-through caches.
+type PullThrough struct {
+	Prefixes map[string]string `json:"prefixes,omitempty"`
+	Enforce  bool              `json:"enforce"`
+}
+
+// Enabled reports whether public images are rewritten to pull-through caches.
+func (p PullThrough) Enabled() bool {
+	return len(p.Prefixes) > 0
+}
+
+// Default returns the configuration used when nothing overrides it.
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			Port:             8000,
+			TLSCert:          "/tls/tls.crt",
+			TLSKey:           "/tls/tls.key",
+			AdminPort:        9090,
+			AdmissionTimeout: metav1.Duration{Duration: 10 * time.Second},
+			TimeoutHeadroom:  metav1.Duration{Duration: time.Second},
+		},
+		AWS: AWS{
+			MaxRetries: 3,
+			CircuitBreaker: CircuitBreaker{
+				Failures: 5,
+				Cooldown: metav1.Duration{Duration: 30 * time.Second},
+			},
+		},
+		Log:                  Log{Level: log.InfoLevel.String(), Format: LogFormatJSON, DecisionSampleRatio: 1},
+		Policy:               DefaultPolicy(),
+		PolicyReloadInterval: metav1.Duration{Duration: 10 * time.Second},
+		Cache: Cache{
+			ECRTTL:      metav1.Duration{Duration: 5 * time.Minute},
+			SSMTTL:      metav1.Duration{Duration: 10 * time.Second},
+			NegativeTTL: metav1.Duration{Duration: 10 * time.Second},
+		},
+		LastKnownTags: LastKnownTags{
+			MaxStaleness:     metav1.Duration{Duration: 24 * time.Hour},
+			SnapshotInterval: metav1.Duration{Duration: 30 * time.Second},
+		},
+		Warmup:  Warmup{Interval: metav1.Duration{Duration: time.Minute}},
+		Tracing: Tracing{SampleRatio: 1},
+		AuditTrail: AuditTrail{
+			MaxFileSize: 10 << 20,
+			MaxFiles:    10,
+		},
+	}
+}
+
+// LookupEnv retrieves the value of an environment variable; e.g. os.LookupEnv.
+type LookupEnv func(key string) (string, bool)
+
+// Load reads the configuration from the file given by the -config flag or the
+// CONFIG_FILE environment variable, applies the environment and flag overrides
+// and validates the result.
+func Load(args []string, lookupEnv LookupEnv) (*Config, error) {
+	var (
+		fs         = flag.NewFlagSet("webhook", flag.ContinueOnError)
+		file       = fs.String("config", "", "path of the YAML configuration file")
+		port       = fs.Int("port", 0, "port of the admission listener")
+		logLevel   = fs.String("log-level", "", "log level")
+		region     = fs.String("region", "", "default AWS region of the registries")
+		deployment = fs.String("deployment-namespace", "", "namespace whose deployments are mutated")
+		policyFile = fs.String("policy", "", "path of the YAML policy file, reloaded when it changes")
+	)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+	path := *file
+	if path == "" {
+		path, _ = lookupEnv("CONFIG_FILE")
+	}
+	if path != "" {
+		if err := cfg.readFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.applyEnv(lookupEnv); err != nil {
+		return nil, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Server.Port = *port
+		case "log-level":
+			cfg.Log.Level = *logLevel
+		case "region":
+			cfg.AWS.Region = *region
+		case "deployment-namespace":
+			cfg.Namespaces.Deployment = *deployment
+		case "policy":
+			cfg.PolicyFile = *policyFile
+		}
+	})
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: reading %s: %w", path, err)
+	}
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return fmt.Errorf("config: parsing %s: %w", path, err)
+	}
+	return nil
+}
+
+// applyEnv overrides the configuration with the environment variables the webhook
+// historically read its settings from.
+func (c *Config) applyEnv(lookupEnv LookupEnv) error {
+	var err error
+	if value, ok := lookupEnv("PORT"); ok && value != "" {
+		if c.Server.Port, err = strconv.Atoi(value); err != nil {
+			return fmt.Errorf("config: PORT: invalid port %q", value)
+		}
+	}
+	if value, ok := lookupEnv("ADMIN_PORT"); ok && value != "" {
+		if c.Server.AdminPort, err = strconv.Atoi(value); err != nil {
+			return fmt.Errorf("config: ADMIN_PORT: invalid port %q", value)
+		}
+	}
+	if value, ok := lookupEnv("LOG_LEVEL"); ok && value != "" {
+		c.Log.Level = value
+	}
+	if value, ok := lookupEnv("LOG_FORMAT"); ok && value != "" {
+		c.Log.Format = value
+	}
+	if value, ok := lookupEnv("LOG_DECISION_SAMPLE_RATIO"); ok {
+		if c.Log.DecisionSampleRatio, err = strconv.ParseFloat(value, 64); err != nil {
+			return fmt.Errorf("config: LOG_DECISION_SAMPLE_RATIO: invalid ratio %q", value)
+		}
+	}
+	// REGISTRY_REGION takes precedence over AWS_DEFAULT_REGION.
+	if value, ok := lookupEnv("REGISTRY_REGION"); ok {
+		c.AWS.Region = value
+	} else if value, ok := lookupEnv("AWS_DEFAULT_REGION"); ok {
+		c.AWS.Region = value
+	}
+	if value, ok := lookupEnv("ECR_ACCOUNT_ROLES"); ok {
+		if c.AWS.AccountRoles, err = parsePairs("ECR_ACCOUNT_ROLES", value); err != nil {
+			return err
+		}
+	}
+	if value, ok := lookupEnv("SSM_REGION_FROM_IMAGE"); ok {
+		if c.AWS.SSMRegionFromImage, err = parseBool("SSM_REGION_FROM_IMAGE", value); err != nil {
+			return err
+		}
+	}
+	if value, ok := lookupEnv("AUDIT_DIR"); ok {
+		c.AuditTrail.Dir = value
+	}
+	if value, ok := lookupEnv("AUDIT_TOKEN_FILE"); ok {
+		c.AuditTrail.TokenFile = value
+	}
+	if value, ok := lookupEnv("AUDIT_MAX_FILE_SIZE"); ok {
+		if c.AuditTrail.MaxFileSize, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return fmt.Errorf("config: AUDIT_MAX_FILE_SIZE: invalid integer %q", value)
+		}
+	}
+	if value, ok := lookupEnv("TRACING_ENDPOINT"); ok {
+		c.Tracing.Endpoint = value
+	}
+	if value, ok := lookupEnv("TRACING_INSECURE"); ok {
+		if c.Tracing.Insecure, err = parseBool("TRACING_INSECURE", value); err != nil {
+			return err
+		}
+	}
+	if value, ok := lookupEnv("TRACING_SAMPLE_RATIO"); ok {
+		if c.Tracing.SampleRatio, err = strconv.ParseFloat(value, 64); err != nil {
+			return fmt.Errorf("config: TRACING_SAMPLE_RATIO: invalid ratio %q", value)
+		}
+	}
+	ints := []struct {
+		name string
+		i    *int
+	}{
+		{"AWS_MAX_RETRIES", &c.AWS.MaxRetries},
+		{"CIRCUIT_BREAKER_FAILURES", &c.AWS.CircuitBreaker.Failures},
+		{"AUDIT_MAX_FILES", &c.AuditTrail.MaxFiles},
+	}
+	for _, i := range ints {
+		if value, ok := lookupEnv(i.name); ok {
+			if *i.i, err = strconv.Atoi(value); err != nil {
+				return fmt.Errorf("config: %s: invalid integer %q", i.name, value)
+			}
+		}
+	}
+	if value, ok := lookupEnv("DEPLOYMENT_NAMESPACE"); ok {
+		c.Namespaces.Deployment = value
+	}
+	if value, ok := lookupEnv("POLICY_FILE"); ok {
+		c.PolicyFile = value
+	}
+	if value, ok := lookupEnv("REPLICA_REGION"); ok {
+		c.Replication.Region = value
+	}
+	if value, ok := lookupEnv("REPLICA_REGISTRIES"); ok {
+		if c.Replication.Registries, err = parsePairs("REPLICA_REGISTRIES", value); err != nil {
+			return err
+		}
+	}
+	if value, ok := lookupEnv("PULL_THROUGH_CACHE"); ok {
+		if c.PullThrough.Prefixes, err = parsePairs("PULL_THROUGH_CACHE", value); err != nil {
+			return err
+		}
+	}
+	if value, ok := lookupEnv("PULL_THROUGH_ENFORCE"); ok {
+		if c.PullThrough.Enforce, err = parseBool("PULL_THROUGH_ENFORCE", value); err != nil {
+			return err
+		}
+	}
+	if value, ok := lookupEnv("TAG_POLICIES"); ok {
+		if c.TagPolicies, err = parseBool("TAG_POLICIES", value); err != nil {
+			return err
+		}
+	}
+	if value, ok := lookupEnv("LAST_KNOWN_SNAPSHOT_FILE"); ok {
+		c.LastKnownTags.SnapshotFile = value
+	}
+	if value, ok := lookupEnv("LAST_KNOWN_SNAPSHOT_CONFIGMAP"); ok {
+		c.LastKnownTags.SnapshotConfigMap = value
+	}
+	if value, ok := lookupEnv("WARMUP_PATHS"); ok {
+		c.Warmup.Paths = parseList(value)
+	}
+	durations := []struct {
+		name string
+		d    *metav1.Duration
+	}{
+		{"CACHE_ECR_TTL", &c.Cache.ECRTTL},
+		{"CACHE_SSM_TTL", &c.Cache.SSMTTL},
+		{"CACHE_NEGATIVE_TTL", &c.Cache.NegativeTTL},
+		{"LAST_KNOWN_MAX_STALENESS", &c.LastKnownTags.MaxStaleness},
+		{"WARMUP_INTERVAL", &c.Warmup.Interval},
+		{"ADMISSION_TIMEOUT", &c.Server.AdmissionTimeout},
+		{"TIMEOUT_HEADROOM", &c.Server.TimeoutHeadroom},
+		{"CIRCUIT_BREAKER_COOLDOWN", &c.AWS.CircuitBreaker.Cooldown},
+	}
+	for _, d := range durations {
+		if value, ok := lookupEnv(d.name); ok {
+			if d.d.Duration, err = parseDuration(d.name, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parsePairs parses a comma separated list of key=value pairs.
+func parsePairs(name, value string) (map[string]string, error) {
+	pairs := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		segments := strings.SplitN(entry, "=", 2)
+		if len(segments) != 2 || segments[0] == "" || segments[1] == "" {
+			return nil, fmt.Errorf("config: %s: malformed entry %q, expected key=value", name, entry)
+		}
+		pairs[segments[0]] = segments[1]
+	}
+	return pairs, nil
+}
+
+// parseList parses a comma separated list.
+func parseList(value string) []string {
+	var list []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+func parseBool(name, value string) (bool, error) {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("config: %s: invalid boolean %q", name, value)
+	}
+	return b, nil
+}
+
+func parseDuration(name, value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("config: %s: invalid duration %q", name, value)
+	}
+	return d, nil
+}
+
+var (
+	accountIDRegex = regexp.MustCompile(`^[0-9]{12}$`)
+	regionRegex    = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+	ecrHostRegex   = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9-_]*\.dkr\.(ecr|ecr-fips)\.[a-z][a-z0-9-_]*\.amazonaws\.com(\.cn)?$`)
+)
+
+// ValidationError lists every invalid field of a configuration.
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "config: " + strings.Join(e, "; ")
+}
+
+func (e *ValidationError) add(field, format string, args ...interface{}) {
+	*e = append(*e, fmt.Sprintf("%s: %s", field, fmt.Sprintf(format, args...)))
+}
+
+// Validate checks the configuration, reporting every invalid field at once.
+func (c *Config) Validate() error {
+	var errs ValidationError
+	add := errs.add
+
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		add("server.port", "must be between 1 and 65535, got %d", c.Server.Port)
+	}
+	if c.Server.AdminPort < 1 || c.Server.AdminPort > 65535 {
+		add("server.adminPort", "must be between 1 and 65535, got %d", c.Server.AdminPort)
+	} else if c.Server.AdminPort == c.Server.Port {
+		add("server.adminPort", "must differ from server.port %d", c.Server.Port)
+	}
+	if c.Server.TLSCert == "" {
+		add("server.tlsCert", "required")
+	}
+	if c.Server.TLSKey == "" {
+		add("server.tlsKey", "required")
+	}
+	if c.Server.AdmissionTimeout.Duration < time.Second || c.Server.AdmissionTimeout.Duration > MaxAdmissionTimeout {
+		add("server.admissionTimeout", "must be between 1s and %s, got %s", MaxAdmissionTimeout, c.Server.AdmissionTimeout.Duration)
+	}
+	if c.Server.TimeoutHeadroom.Duration < 0 {
+		add("server.timeoutHeadroom", "must not be negative, got %s", c.Server.TimeoutHeadroom.Duration)
+	} else if c.Server.TimeoutHeadroom.Duration >= c.Server.AdmissionTimeout.Duration {
+		add("server.timeoutHeadroom", "must be less than server.admissionTimeout %s, got %s", c.Server.AdmissionTimeout.Duration, c.Server.TimeoutHeadroom.Duration)
+	}
+	if _, err := log.ParseLevel(c.Log.Level); err != nil {
+		add("log.level", "unknown level %q", c.Log.Level)
+	}
+	if c.Log.Format != LogFormatJSON && c.Log.Format != LogFormatText {
+		add("log.format", "must be %s or %s, got %q", LogFormatJSON, LogFormatText, c.Log.Format)
+	}
+	if c.Log.DecisionSampleRatio < 0 || c.Log.DecisionSampleRatio > 1 {
+		add("log.decisionSampleRatio", "must be between 0 and 1, got %g", c.Log.DecisionSampleRatio)
+	}
+	if c.AWS.Region == "" {
+		add("aws.region", "required, set it or REGISTRY_REGION or AWS_DEFAULT_REGION")
+	} else if !regionRegex.MatchString(c.AWS.Region) {
+		add("aws.region", "invalid region %q", c.AWS.Region)
+	}
+	for _, account := range sortedKeys(c.AWS.AccountRoles) {
+		role := c.AWS.AccountRoles[account]
+		if !accountIDRegex.MatchString(account) {
+			add("aws.accountRoles", "invalid account ID %q", account)
+		}
+		if !strings.HasPrefix(role, "arn:") {
+			add("aws.accountRoles", "invalid role ARN %q for account %s", role, account)
+		}
+	}
+	if c.AWS.MaxRetries < 0 {
+		add("aws.maxRetries", "must not be negative, got %d", c.AWS.MaxRetries)
+	}
+	if c.AWS.CircuitBreaker.Failures < 0 {
+		add("aws.circuitBreaker.failures", "must not be negative, got %d", c.AWS.CircuitBreaker.Failures)
+	}
+	if c.AWS.CircuitBreaker.Failures > 0 && c.AWS.CircuitBreaker.Cooldown.Duration <= 0 {
+		add("aws.circuitBreaker.cooldown", "must be positive, got %s", c.AWS.CircuitBreaker.Cooldown.Duration)
+	}
+	if c.Replication.Region != "" && !regionRegex.MatchString(c.Replication.Region) {
+		add("replication.region", "invalid region %q", c.Replication.Region)
+	}
+	for _, source := range sortedKeys(c.Replication.Registries) {
+		replica := c.Replication.Registries[source]
+		if !ecrHostRegex.MatchString(source) {
+			add("replication.registries", "source %q is not an ecr registry host", source)
+		}
+		if !ecrHostRegex.MatchString(replica) {
+			add("replication.registries", "replica %q of %s is not an ecr registry host", replica, source)
+		}
+	}
+	for _, upstream := range sortedKeys(c.PullThrough.Prefixes) {
+		prefix := c.PullThrough.Prefixes[upstream]
+		if host := strings.SplitN(prefix, "/", 2)[0]; !ecrHostRegex.MatchString(host) {
+			add("pullThrough.prefixes", "prefix %q of %s is not in an ecr registry", prefix, upstream)
+		}
+	}
+	if c.PolicyReloadInterval.Duration <= 0 {
+		add("policyReloadInterval", "must be positive, got %s", c.PolicyReloadInterval.Duration)
+	}
+	ttls := []struct {
+		field string
+		ttl   time.Duration
+	}{
+		{"cache.ecrTTL", c.Cache.ECRTTL.Duration},
+		{"cache.ssmTTL", c.Cache.SSMTTL.Duration},
+		{"cache.negativeTTL", c.Cache.NegativeTTL.Duration},
+		{"lastKnownTags.maxStaleness", c.LastKnownTags.MaxStaleness.Duration},
+	}
+	for _, t := range ttls {
+		if t.ttl < 0 {
+			add(t.field, "must not be negative, got %s", t.ttl)
+		}
+	}
+	if c.LastKnownTags.SnapshotFile != "" && c.LastKnownTags.SnapshotConfigMap != "" {
+		add("lastKnownTags", "only one of snapshotFile and snapshotConfigMap can be set")
+	}
+	if c.LastKnownTags.SnapshotConfigMap != "" {
+		if _, _, err := c.LastKnownTags.ConfigMap(); err != nil {
+			add("lastKnownTags.snapshotConfigMap", "%v", err)
+		}
+	}
+	if c.LastKnownTags.SnapshotInterval.Duration <= 0 {
+		add("lastKnownTags.snapshotInterval", "must be positive, got %s", c.LastKnownTags.SnapshotInterval.Duration)
+	}
+	for _, p := range c.Warmup.Paths {
+		if !strings.HasPrefix(p, "/") {
+			add("warmup.paths", "invalid path %q, must start with /", p)
+		}
+	}
+	if len(c.Warmup.Paths) > 0 {
+		if c.Warmup.Interval.Duration <= 0 {
+			add("warmup.interval", "must be positive, got %s", c.Warmup.Interval.Duration)
+		}
+		if c.Cache.SSMTTL.Duration == 0 {
+			add("warmup.paths", "the warm-up loads the SSM cache, which cache.ssmTTL disables")
+		}
+		if c.AWS.SSMRegionFromImage {
+			add("warmup.paths", "the warm-up loads the parameters of the default region, which aws.ssmRegionFromImage does not read")
+		}
+	}
+	if c.AuditTrail.Dir != "" {
+		if c.AuditTrail.MaxFileSize <= 0 {
+			add("auditTrail.maxFileSize", "must be positive, got %d", c.AuditTrail.MaxFileSize)
+		}
+		if c.AuditTrail.MaxFiles < 0 {
+			add("auditTrail.maxFiles", "must not be negative, got %d", c.AuditTrail.MaxFiles)
+		}
+		if c.AuditTrail.TokenFile == "" {
+			add("auditTrail.tokenFile", "required to authenticate the queries of the trail")
+		}
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		add("tracing.sampleRatio", "must be between 0 and 1, got %g", c.Tracing.SampleRatio)
+	}
+	c.Policy.validate(&errs)
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of the map in order, so that errors are reported deterministically.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
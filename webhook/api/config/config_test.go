@@ -0,0 +1,138 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func env(vars map[string]string) LookupEnv {
+	return func(key string) (string, bool) {
+		value, ok := vars[key]
+		return value, ok
+	}
+}
+
+func TestLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(file, []byte(`
+server:
+  port: 8443
+log:
+  level: debug
+aws:
+  region: eu-west-1
+namespaces:
+  deployment: staging
+`), 0600))
+
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want func(*Config)
+	}{
+		{
+			name: "Environment",
+			env:  map[string]string{"AWS_DEFAULT_REGION": "eu-west-3", "DEPLOYMENT_NAMESPACE": "develop", "PULL_THROUGH_CACHE": "docker.io=123456789012.dkr.ecr.eu-west-3.amazonaws.com/docker-hub"},
+			want: func(c *Config) {
+				c.AWS.Region = "eu-west-3"
+				c.Namespaces.Deployment = "develop"
+				c.PullThrough.Prefixes = map[string]string{"docker.io": "123456789012.dkr.ecr.eu-west-3.amazonaws.com/docker-hub"}
+			},
+		},
+		{
+			name: "CacheTTLs",
+			env:  map[string]string{"AWS_DEFAULT_REGION": "eu-west-3", "CACHE_SSM_TTL": "0s", "CACHE_NEGATIVE_TTL": "1m"},
+			want: func(c *Config) {
+				c.AWS.Region = "eu-west-3"
+				c.Cache.SSMTTL.Duration = 0
+				c.Cache.NegativeTTL.Duration = time.Minute
+			},
+		},
+		{
+			name: "Resilience",
+			env:  map[string]string{"AWS_DEFAULT_REGION": "eu-west-3", "TIMEOUT_HEADROOM": "2s", "AWS_MAX_RETRIES": "5", "CIRCUIT_BREAKER_FAILURES": "0"},
+			want: func(c *Config) {
+				c.AWS.Region = "eu-west-3"
+				c.Server.TimeoutHeadroom.Duration = 2 * time.Second
+				c.AWS.MaxRetries = 5
+				c.AWS.CircuitBreaker.Failures = 0
+			},
+		},
+		{
+			name: "RegistryRegionPrecedence",
+			env:  map[string]string{"AWS_DEFAULT_REGION": "eu-west-3", "REGISTRY_REGION": "us-east-1"},
+			want: func(c *Config) {
+				c.AWS.Region = "us-east-1"
+			},
+		},
+		{
+			name: "FileThenEnvironmentThenFlags",
+			args: []string{"-config", file, "-deployment-namespace", "prod"},
+			env:  map[string]string{"PORT": "9443"},
+			want: func(c *Config) {
+				c.Server.Port = 9443
+				c.Log.Level = "debug"
+				c.AWS.Region = "eu-west-1"
+				c.Namespaces.Deployment = "prod"
+			},
+		},
+		{
+			name: "FileFromEnvironment",
+			env:  map[string]string{"CONFIG_FILE": file},
+			want: func(c *Config) {
+				c.Server.Port = 8443
+				c.Log.Level = "debug"
+				c.AWS.Region = "eu-west-1"
+				c.Namespaces.Deployment = "staging"
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Load(tt.args, env(tt.env))
+			require.NoError(t, err)
+			want := Default()
+			tt.want(want)
+			require.Equal(t, want, got)
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(file, []byte("aws:\n  regoin: eu-west-1\n"), 0600))
+
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		wantErr string
+	}{
+		{"MissingRegion", nil, nil, "config: aws.region: required, set it or REGISTRY_REGION or AWS_DEFAULT_REGION"},
+		{"InvalidPort", nil, map[string]string{"AWS_DEFAULT_REGION": "eu-west-3", "PORT": "http"}, `config: PORT: invalid port "http"`},
+		{"InvalidDuration", nil, map[string]string{"AWS_DEFAULT_REGION": "eu-west-3", "CACHE_ECR_TTL": "-1m"}, `config: CACHE_ECR_TTL: invalid duration "-1m"`},
+		{"InvalidInteger", nil, map[string]string{"AWS_DEFAULT_REGION": "eu-west-3", "AWS_MAX_RETRIES": "many"}, `config: AWS_MAX_RETRIES: invalid integer "many"`},
+		{"HeadroomBeyondTimeout", nil, map[string]string{"AWS_DEFAULT_REGION": "eu-west-3", "ADMISSION_TIMEOUT": "1s"}, "config: server.timeoutHeadroom: must be less than server.admissionTimeout 1s, got 1s"},
+		{"WarmupWithRegionFromImage", nil, map[string]string{"AWS_DEFAULT_REGION": "eu-west-3", "WARMUP_PATHS": "/gmt", "SSM_REGION_FROM_IMAGE": "true"}, "config: warmup.paths: the warm-up loads the parameters of the default region, which aws.ssmRegionFromImage does not read"},
+		{"MalformedPairs", nil, map[string]string{"AWS_DEFAULT_REGION": "eu-west-3", "ECR_ACCOUNT_ROLES": "111122223333"}, `config: ECR_ACCOUNT_ROLES: malformed entry "111122223333", expected key=value`},
+		{"UnknownField", []string{"-config", file}, nil, `error unmarshaling JSON: while decoding JSON: json: unknown field "regoin"`},
+		{
+			"EveryInvalidField",
+			[]string{"-port", "0", "-log-level", "loud"},
+			map[string]string{"AWS_DEFAULT_REGION": "eu-west-3", "ECR_ACCOUNT_ROLES": "alias=role"},
+			`config: server.port: must be between 1 and 65535, got 0; log.level: unknown level "loud"; aws.accountRoles: invalid account ID "alias"; aws.accountRoles: invalid role ARN "role" for account alias`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(tt.args, env(tt.env))
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
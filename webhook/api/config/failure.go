@@ -0,0 +1,113 @@
+package config
+
+// ErrorClass classifies the errors an admission can fail with.
+type ErrorClass string
+
+// Error classes.
+const (
+	// ErrorAWSUnavailable is any error reaching AWS; e.g. throttling, timeouts or missing credentials.
+	ErrorAWSUnavailable ErrorClass = "awsUnavailable"
+	// ErrorParameterMissing is a tag parameter that does not exist or cannot be named.
+	ErrorParameterMissing ErrorClass = "parameterMissing"
+	// ErrorRepositoryNotFound is an image whose ECR repository does not exist.
+	ErrorRepositoryNotFound ErrorClass = "repositoryNotFound"
+	// ErrorPolicyViolation is a repository or image failing the compliance checks, or a
+	// deployment asking for parameters it may not read.
+	ErrorPolicyViolation ErrorClass = "policyViolation"
+	// ErrorMisconfiguration is an AWS request rejected as invalid or forbidden; e.g. a
+	// parameter path SSM does not accept, or the webhook's role being denied access.
+	ErrorMisconfiguration ErrorClass = "misconfiguration"
+)
+
+// FailAction is the outcome of an admission failing with an error class.
+type FailAction string
+
+// Fail actions.
+const (
+	// ActionDeny denies the admission.
+	ActionDeny FailAction = "deny"
+	// ActionAllow allows the admission without mutating its images.
+	ActionAllow FailAction = "allow"
+	// ActionLastKnownTag allows the admission with the tag last resolved for the image,
+	// and without mutating its images when no tag was resolved since the webhook started.
+	ActionLastKnownTag FailAction = "lastKnownTag"
+)
+
+// OnFailure chooses the action taken for each error class. The classes left
+// empty are inherited from the profile, and default to the profile's fail mode;
+// policy violations and misconfigurations are always denied unless their action is set.
+type OnFailure struct {
+	AWSUnavailable     FailAction `json:"awsUnavailable,omitempty"`
+	ParameterMissing   FailAction `json:"parameterMissing,omitempty"`
+	RepositoryNotFound FailAction `json:"repositoryNotFound,omitempty"`
+	PolicyViolation    FailAction `json:"policyViolation,omitempty"`
+	Misconfiguration   FailAction `json:"misconfiguration,omitempty"`
+}
+
+// Merge returns the actions with those set on the override replacing them.
+func (o OnFailure) Merge(override OnFailure) OnFailure {
+	if override.AWSUnavailable != "" {
+		o.AWSUnavailable = override.AWSUnavailable
+	}
+	if override.ParameterMissing != "" {
+		o.ParameterMissing = override.ParameterMissing
+	}
+	if override.RepositoryNotFound != "" {
+		o.RepositoryNotFound = override.RepositoryNotFound
+	}
+	if override.PolicyViolation != "" {
+		o.PolicyViolation = override.PolicyViolation
+	}
+	if override.Misconfiguration != "" {
+		o.Misconfiguration = override.Misconfiguration
+	}
+	return o
+}
+
+// Action returns the action set for the error class, empty when none is.
+func (o OnFailure) Action(class ErrorClass) FailAction {
+	switch class {
+	case ErrorAWSUnavailable:
+		return o.AWSUnavailable
+	case ErrorParameterMissing:
+		return o.ParameterMissing
+	case ErrorRepositoryNotFound:
+		return o.RepositoryNotFound
+	case ErrorPolicyViolation:
+		return o.PolicyViolation
+	case ErrorMisconfiguration:
+		return o.Misconfiguration
+	}
+	return ""
+}
+
+// Action returns the action taken when an admission fails with the error class.
+func (p Profile) Action(class ErrorClass) FailAction {
+	if action := p.OnFailure.Action(class); action != "" {
+		return action
+	}
+	if class != ErrorPolicyViolation && class != ErrorMisconfiguration && p.FailMode == FailOpen {
+		return ActionAllow
+	}
+	return ActionDeny
+}
+
+func (o OnFailure) validate(errs *ValidationError, field string) {
+	actions := []struct {
+		name   string
+		action FailAction
+	}{
+		{"awsUnavailable", o.AWSUnavailable},
+		{"parameterMissing", o.ParameterMissing},
+		{"repositoryNotFound", o.RepositoryNotFound},
+		{"policyViolation", o.PolicyViolation},
+		{"misconfiguration", o.Misconfiguration},
+	}
+	for _, a := range actions {
+		switch a.action {
+		case "", ActionDeny, ActionAllow, ActionLastKnownTag:
+		default:
+			errs.add(field+a.name, "unknown action %q, expected %s, %s or %s", a.action, ActionDeny, ActionAllow, ActionLastKnownTag)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// DefaultNamingTemplate is the repository naming convention "project-type"; e.g. gmt-backend.
+const DefaultNamingTemplate = "{project}-{type}"
+
+// repositorySeparators are the characters allowed in repository names besides lowercase letters and digits.
+const repositorySeparators = "._-/"
+
+var placeholderRegex = regexp.MustCompile(`\{([a-zA-Z][a-zA-Z0-9]*)\}`)
+
+// NamingTemplate extracts the fields of a repository name, such as {project} and {type},
+// which are then replaced in the parameter prefix. A field never spans / nor the separators
+// (., _ or -) written in the template. When the template ends with a field,
+// further segments are ignored; e.g. {project}-{type} reads gmt-backend-api as gmt and backend.
+type NamingTemplate struct {
+	template string
+	fields   []string
+	regex    *regexp.Regexp
+}
+
+var namingTemplates sync.Map // string -> *NamingTemplate
+
+// ParseNamingTemplate parses the template, reusing the templates parsed before.
+func ParseNamingTemplate(template string) (*NamingTemplate, error) {
+	if t, ok := namingTemplates.Load(template); ok {
+		return t.(*NamingTemplate), nil
+	}
+	t, err := parseNamingTemplate(template)
+	if err != nil {
+		return nil, err
+	}
+	namingTemplates.Store(template, t)
+	return t, nil
+}
+
+func parseNamingTemplate(template string) (*NamingTemplate, error) {
+	locs := placeholderRegex.FindAllStringSubmatchIndex(template, -1)
+	if len(locs) == 0 {
+		return nil, fmt.Errorf("naming template %q has no field", template)
+	}
+
+	t := &NamingTemplate{template: template}
+	var literals []string
+	seen := make(map[string]bool)
+	pos := 0
+	for i, loc := range locs {
+		literal, field := template[pos:loc[0]], template[loc[2]:loc[3]]
+		if i > 0 && literal == "" {
+			return nil, fmt.Errorf("naming template %q needs a separator before {%s}", template, field)
+		}
+		if field == "environment" {
+			return nil, fmt.Errorf("naming template %q cannot use the reserved field {environment}", template)
+		}
+		if seen[field] {
+			return nil, fmt.Errorf("naming template %q repeats the field {%s}", template, field)
+		}
+		seen[field] = true
+		literals = append(literals, literal)
+		t.fields = append(t.fields, field)
+		pos = loc[1]
+	}
+	trailing := template[pos:]
+	if strings.ContainsAny(strings.Join(append(literals, trailing), ""), "{}") {
+		return nil, fmt.Errorf("naming template %q has an unbalanced brace", template)
+	}
+
+	// The separators are excluded from the fields, escaped as code points to be
+	// safe within a character class.
+	separators := "/"
+	for _, r := range strings.Join(append(literals, trailing), "") {
+		if strings.ContainsRune(repositorySeparators, r) && !strings.ContainsRune(separators, r) {
+			separators += string(r)
+		}
+	}
+	var class strings.Builder
+	for _, r := range separators {
+		fmt.Fprintf(&class, `\x{%x}`, r)
+	}
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i, field := range t.fields {
+		fmt.Fprintf(&expr, "%s(?P<%s>[^%s]+)", regexp.QuoteMeta(literals[i]), field, class.String())
+	}
+	if trailing == "" {
+		fmt.Fprintf(&expr, "(?:[%s].*)?$", class.String())
+	} else {
+		fmt.Fprintf(&expr, "%s$", regexp.QuoteMeta(trailing))
+	}
+	regex, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, fmt.Errorf("naming template %q: %w", template, err)
+	}
+	t.regex = regex
+	return t, nil
+}
+
+// Fields returns the names of the template's fields, in order.
+func (t *NamingTemplate) Fields() []string {
+	return t.fields
+}
+
+// Match extracts the fields of the repository name.
+func (t *NamingTemplate) Match(repo string) (map[string]string, error) {
+	matches := t.regex.FindStringSubmatch(repo)
+	if matches == nil {
+		return nil, fmt.Errorf("repository %q does not follow the naming template %q", repo, t.template)
+	}
+	fields := make(map[string]string, len(t.fields))
+	for i, field := range t.fields {
+		fields[field] = matches[i+1]
+	}
+	return fields, nil
+}
+
+// Parameter returns the path of the repository's tag parameter from the prefix. Without
+// an environment, e.g. under the default profile, a segment only made of {environment}
+// is dropped rather than left empty; e.g. /app/{environment}/tag gives /app/tag/ecr_tag.
+func (t *NamingTemplate) Parameter(prefix, environment, repo string) (string, error) {
+	fields, err := t.Match(repo)
+	if err != nil {
+		return "", err
+	}
+	pairs := []string{"{environment}", environment}
+	for _, field := range t.fields {
+		pairs = append(pairs, "{"+field+"}", fields[field])
+	}
+	segments := strings.Split(strings.NewReplacer(pairs...).Replace(prefix), "/")
+	name := segments[:1]
+	for _, segment := range segments[1:] {
+		if segment != "" {
+			name = append(name, segment)
+		}
+	}
+	return strings.Join(append(name, "ecr_tag"), "/"), nil
+}
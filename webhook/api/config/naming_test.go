@@ -0,0 +1,49 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamingTemplateParameter(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		prefix   string
+		repo     string
+		env      string
+		want     string
+		wantErr  bool
+	}{
+		{"Default", DefaultNamingTemplate, DefaultParameterPrefix, "gmt-backend", "staging", "/gmt/backend/ecr_tag", false},
+		{"ExtraSegmentsIgnored", DefaultNamingTemplate, DefaultParameterPrefix, "gmt-backend-api", "staging", "/gmt/backend/ecr_tag", false},
+		{"Environment", DefaultNamingTemplate, "/{project}/{type}/{environment}", "gmt-frontend", "staging", "/gmt/frontend/staging/ecr_tag", false},
+		{"Namespaced", "{team}/{project}.{type}", "/{team}/{project}/{type}", "data/etl.worker", "staging", "/data/etl/worker/ecr_tag", false},
+		{"TrailingLiteral", "{project}-{type}-app", DefaultParameterPrefix, "gmt-backend-app", "staging", "/gmt/backend/ecr_tag", false},
+		{"NoSeparator", DefaultNamingTemplate, DefaultParameterPrefix, "gmt", "staging", "", true},
+		{"NoEnvironment", DefaultNamingTemplate, "/app/{environment}/{project}", "gmt-backend", "", "/app/gmt/ecr_tag", false},
+		{"NoEnvironmentLast", DefaultNamingTemplate, "/{project}/{type}/{environment}", "gmt-backend", "", "/gmt/backend/ecr_tag", false},
+		{"TrailingLiteralMissing", "{project}-{type}-app", DefaultParameterPrefix, "gmt-backend", "staging", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			template, err := ParseNamingTemplate(tt.template)
+			require.NoError(t, err)
+			got, err := template.Parameter(tt.prefix, tt.env, tt.repo)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseNamingTemplateInvalid(t *testing.T) {
+	for _, template := range []string{"project-type", "{project}{type}", "{project}-{project}", "{project}-{environment}", "{project}-{type"} {
+		_, err := ParseNamingTemplate(template)
+		require.Error(t, err, template)
+	}
+}
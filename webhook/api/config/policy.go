@@ -0,0 +1,490 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+// Policy decides which deployments are mutated and which checks they must pass.
+// Unlike the rest of the configuration, it can change while the webhook runs.
+type Policy struct {
+	Namespaces Namespaces `json:"namespaces"`
+	// ObjectSelector, when set, restricts the mutated deployments to those whose labels match.
+	ObjectSelector *metav1.LabelSelector `json:"objectSelector,omitempty"`
+	Checks         Checks                `json:"checks"`
+	// OnFailure chooses the outcome of admissions failing with each error class.
+	OnFailure OnFailure `json:"onFailure,omitempty"`
+	// Mode audits rather than enforces admissions when set to audit.
+	Mode Mode `json:"mode,omitempty"`
+	// Version injects the resolved tag into the deployments as their version.
+	Version VersionInjection `json:"version,omitempty"`
+	// Environments map namespaces to environment profiles. A deployment gets the
+	// profile of the first environment matching its namespace, and the default
+	// profile when none does.
+	Environments []Environment `json:"environments,omitempty"`
+}
+
+// Namespaces configures the namespaces whose deployments are mutated. A namespace
+// is mutated when it is the deployment namespace or matches an include rule,
+// unless it is ignored or matches an exclude rule.
+type Namespaces struct {
+	// Deployment is a namespace whose deployments are mutated.
+	Deployment string `json:"deployment"`
+	// Ignored namespaces are always passed without mutation.
+	Ignored []string        `json:"ignored"`
+	Include []NamespaceRule `json:"include,omitempty"`
+	Exclude []NamespaceRule `json:"exclude,omitempty"`
+}
+
+// NamespaceRule matches namespaces by name, glob pattern and labels.
+// Every field that is set must match.
+type NamespaceRule struct {
+	Name string `json:"name,omitempty"`
+	// Pattern is a glob matched against the name; e.g. team-*.
+	Pattern  string                `json:"pattern,omitempty"`
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
+// HasSelector reports whether matching the rule needs the labels of the namespace.
+func (r NamespaceRule) HasSelector() bool {
+	return r.Selector != nil
+}
+
+// TagSource is where the tag of an image is resolved from.
+type TagSource string
+
+// Tag sources.
+const (
+	// TagSourceSSM reads the tag from the repository's SSM parameter.
+	TagSourceSSM TagSource = "ssm"
+	// TagSourceNone keeps the tag the deployment was admitted with.
+	TagSourceNone TagSource = "none"
+)
+
+// FailMode is the outcome of an admission whose image could not be checked or resolved.
+type FailMode string
+
+// Fail modes.
+const (
+	// FailClosed denies the admission.
+	FailClosed FailMode = "closed"
+	// FailOpen allows the admission without mutating its images.
+	FailOpen FailMode = "open"
+)
+
+// Mode is whether admissions are enforced or only audited.
+type Mode string
+
+// Modes.
+const (
+	// ModeEnforce patches and denies deployments.
+	ModeEnforce Mode = "enforce"
+	// ModeAudit allows deployments unmodified, reporting the patches and denials
+	// they would have had in audit annotations and warnings.
+	ModeAudit Mode = "audit"
+)
+
+// DefaultParameterPrefix is the prefix of the tag parameters, following the default
+// naming template; e.g. gmt-backend's tag is read from /gmt/backend/ecr_tag.
+const DefaultParameterPrefix = "/{project}/{type}"
+
+// Environment is a profile applied to the deployments of the namespaces it matches.
+type Environment struct {
+	Name       string          `json:"name"`
+	Namespaces []NamespaceRule `json:"namespaces"`
+	Overrides
+}
+
+// Overrides are settings of a profile; those left empty are inherited from the profile they apply to.
+type Overrides struct {
+	// NamingTemplate extracts the fields of the repository name replaced in the parameter prefix.
+	NamingTemplate string `json:"namingTemplate,omitempty"`
+	// ParameterPrefix is the path of the tag parameter, without the trailing
+	// /ecr_tag; the fields of the naming template and {environment} are replaced.
+	// e.g. /{project}/{type}/staging
+	ParameterPrefix string    `json:"parameterPrefix,omitempty"`
+	TagSource       TagSource `json:"tagSource,omitempty"`
+	Checks          *Checks   `json:"checks,omitempty"`
+	FailMode        FailMode  `json:"failMode,omitempty"`
+	OnFailure       OnFailure `json:"onFailure,omitempty"`
+	Mode            Mode      `json:"mode,omitempty"`
+	// Version, when set, injects the resolved tag into the deployments as their version.
+	Version *VersionInjection `json:"version,omitempty"`
+}
+
+// VersionInjection tells the deployments the tag of their image.
+type VersionInjection struct {
+	// Label sets the app.kubernetes.io/version label on the deployment and its pod template.
+	Label bool `json:"label"`
+	// EnvVar is the name of the environment variable set in the patched containers; e.g. APP_VERSION.
+	EnvVar string `json:"envVar,omitempty"`
+}
+
+// Apply returns the profile with the settings that are set overridden.
+func (o Overrides) Apply(profile Profile) Profile {
+	if o.NamingTemplate != "" {
+		profile.NamingTemplate = o.NamingTemplate
+	}
+	if o.ParameterPrefix != "" {
+		profile.ParameterPrefix = o.ParameterPrefix
+	}
+	if o.TagSource != "" {
+		profile.TagSource = o.TagSource
+	}
+	if o.Checks != nil {
+		profile.Checks = *o.Checks
+	}
+	if o.FailMode != "" {
+		profile.FailMode = o.FailMode
+	}
+	profile.OnFailure = profile.OnFailure.Merge(o.OnFailure)
+	if o.Mode != "" {
+		profile.Mode = o.Mode
+	}
+	if o.Version != nil {
+		profile.Version = *o.Version
+	}
+	return profile
+}
+
+// Profile is the resolved set of settings applied to a deployment.
+type Profile struct {
+	Environment string `json:"environment"`
+	// TagPolicy is the namespace/name of the TagPolicy resource applied, if any.
+	TagPolicy       string           `json:"tagPolicy,omitempty"`
+	NamingTemplate  string           `json:"namingTemplate"`
+	ParameterPrefix string           `json:"parameterPrefix"`
+	TagSource       TagSource        `json:"tagSource"`
+	Checks          Checks           `json:"checks"`
+	FailMode        FailMode         `json:"failMode"`
+	OnFailure       OnFailure        `json:"onFailure"`
+	Mode            Mode             `json:"mode"`
+	Version         VersionInjection `json:"version"`
+}
+
+// Profile returns the profile of the environment, nil being the default profile.
+func (p *Policy) Profile(env *Environment) Profile {
+	profile := Profile{
+		NamingTemplate:  DefaultNamingTemplate,
+		ParameterPrefix: DefaultParameterPrefix,
+		TagSource:       TagSourceSSM,
+		Checks:          p.Checks,
+		FailMode:        FailClosed,
+		OnFailure:       p.OnFailure,
+		Mode:            ModeEnforce,
+		Version:         p.Version,
+	}
+	if p.Mode != "" {
+		profile.Mode = p.Mode
+	}
+	if env == nil {
+		return profile
+	}
+	profile = env.Apply(profile)
+	profile.Environment = env.Name
+	return profile
+}
+
+// Checks configures the compliance checks enforced on top of the repository existing.
+type Checks struct {
+	TagImmutability         bool `json:"tagImmutability"`
+	ScanOnPush              bool `json:"scanOnPush"`
+	CriticalVulnerabilities bool `json:"criticalVulnerabilities"`
+}
+
+// DefaultPolicy returns the policy used when nothing overrides it.
+func DefaultPolicy() Policy {
+	return Policy{
+		Namespaces: Namespaces{
+			Ignored: []string{metav1.NamespaceSystem},
+		},
+	}
+}
+
+// Validate checks the policy, reporting every invalid field at once.
+func (p *Policy) Validate() error {
+	var errs ValidationError
+	p.validate(&errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (p *Policy) validate(errs *ValidationError) {
+	if n := p.Namespaces.Deployment; n != "" {
+		for _, msg := range validation.IsDNS1123Label(n) {
+			errs.add("namespaces.deployment", "invalid namespace %q: %s", n, msg)
+		}
+	}
+	for _, n := range p.Namespaces.Ignored {
+		for _, msg := range validation.IsDNS1123Label(n) {
+			errs.add("namespaces.ignored", "invalid namespace %q: %s", n, msg)
+		}
+	}
+	for i, rule := range p.Namespaces.Include {
+		rule.validate(errs, fmt.Sprintf("namespaces.include[%d]", i))
+	}
+	for i, rule := range p.Namespaces.Exclude {
+		rule.validate(errs, fmt.Sprintf("namespaces.exclude[%d]", i))
+	}
+	if p.ObjectSelector != nil {
+		if _, err := metav1.LabelSelectorAsSelector(p.ObjectSelector); err != nil {
+			errs.add("objectSelector", "%v", err)
+		}
+	}
+	p.OnFailure.validate(errs, "onFailure.")
+	validateMode(errs, "mode", p.Mode)
+	p.Version.validate(errs, "version.")
+	names := make(map[string]bool)
+	for i, env := range p.Environments {
+		env.validate(errs, fmt.Sprintf("environments[%d]", i))
+		if names[env.Name] {
+			errs.add(fmt.Sprintf("environments[%d].name", i), "duplicate environment %q", env.Name)
+		}
+		names[env.Name] = true
+	}
+}
+
+func (e Environment) validate(errs *ValidationError, field string) {
+	if e.Name == "" {
+		errs.add(field+".name", "required")
+	}
+	if len(e.Namespaces) == 0 {
+		errs.add(field+".namespaces", "at least one rule is required")
+	}
+	for i, rule := range e.Namespaces {
+		rule.validate(errs, fmt.Sprintf("%s.namespaces[%d]", field, i))
+	}
+	e.Overrides.validate(errs, field+".")
+}
+
+// Validate checks the overrides, prefixing the invalid fields with field when it is set.
+func (o Overrides) Validate(field string) error {
+	var errs ValidationError
+	if field != "" {
+		field += "."
+	}
+	o.validate(&errs, field)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validate checks the overrides; field is empty or ends with a dot.
+func (o Overrides) validate(errs *ValidationError, field string) {
+	naming := DefaultNamingTemplate
+	if o.NamingTemplate != "" {
+		naming = o.NamingTemplate
+	}
+	template, err := ParseNamingTemplate(naming)
+	if err != nil {
+		errs.add(field+"namingTemplate", "%v", err)
+	}
+	if o.ParameterPrefix != "" {
+		if !strings.HasPrefix(o.ParameterPrefix, "/") || strings.HasSuffix(o.ParameterPrefix, "/") {
+			errs.add(field+"parameterPrefix", "must start and not end with /, got %q", o.ParameterPrefix)
+		}
+		if template != nil {
+			known := map[string]bool{"environment": true}
+			for _, f := range template.Fields() {
+				known[f] = true
+			}
+			for _, m := range placeholderRegex.FindAllStringSubmatch(o.ParameterPrefix, -1) {
+				if !known[m[1]] {
+					errs.add(field+"parameterPrefix", "unknown field %s, not in naming template %q", m[0], naming)
+				}
+			}
+		}
+	}
+	switch o.TagSource {
+	case "", TagSourceSSM, TagSourceNone:
+	default:
+		errs.add(field+"tagSource", "unknown tag source %q, expected %s or %s", o.TagSource, TagSourceSSM, TagSourceNone)
+	}
+	switch o.FailMode {
+	case "", FailClosed, FailOpen:
+	default:
+		errs.add(field+"failMode", "unknown fail mode %q, expected %s or %s", o.FailMode, FailClosed, FailOpen)
+	}
+	o.OnFailure.validate(errs, field+"onFailure.")
+	validateMode(errs, field+"mode", o.Mode)
+	if o.Version != nil {
+		o.Version.validate(errs, field+"version.")
+	}
+}
+
+func (v VersionInjection) validate(errs *ValidationError, field string) {
+	if v.EnvVar != "" {
+		for _, msg := range validation.IsEnvVarName(v.EnvVar) {
+			errs.add(field+"envVar", "invalid environment variable %q: %s", v.EnvVar, msg)
+		}
+	}
+}
+
+func validateMode(errs *ValidationError, field string, mode Mode) {
+	switch mode {
+	case "", ModeEnforce, ModeAudit:
+	default:
+		errs.add(field, "unknown mode %q, expected %s or %s", mode, ModeEnforce, ModeAudit)
+	}
+}
+
+func (r NamespaceRule) validate(errs *ValidationError, field string) {
+	if r.Name == "" && r.Pattern == "" && r.Selector == nil {
+		errs.add(field, "one of name, pattern or selector is required")
+	}
+	if r.Name != "" {
+		for _, msg := range validation.IsDNS1123Label(r.Name) {
+			errs.add(field+".name", "invalid namespace %q: %s", r.Name, msg)
+		}
+	}
+	if r.Pattern != "" {
+		if _, err := path.Match(r.Pattern, ""); err != nil {
+			errs.add(field+".pattern", "invalid pattern %q: %v", r.Pattern, err)
+		}
+	}
+	if r.Selector != nil {
+		if _, err := metav1.LabelSelectorAsSelector(r.Selector); err != nil {
+			errs.add(field+".selector", "%v", err)
+		}
+	}
+}
+
+// ActivePolicy is the policy currently applied to admissions.
+type ActivePolicy struct {
+	Policy   `json:"policy"`
+	Version  string    `json:"version"`
+	LoadedAt time.Time `json:"loadedAt"`
+}
+
+// PolicySource provides the policy applied to an admission.
+type PolicySource interface {
+	Current() *ActivePolicy
+	// Err returns why the policy could not be reloaded, the previous one being kept; nil once it is.
+	Err() error
+}
+
+// StaticPolicy is a PolicySource whose policy never changes.
+type StaticPolicy struct {
+	active *ActivePolicy
+}
+
+// NewStaticPolicy creates a StaticPolicy serving the policy of the configuration.
+func NewStaticPolicy(policy Policy) *StaticPolicy {
+	return &StaticPolicy{active: &ActivePolicy{Policy: policy, Version: "static", LoadedAt: time.Now()}}
+}
+
+// Current returns the policy.
+func (s *StaticPolicy) Current() *ActivePolicy {
+	return s.active
+}
+
+// Err returns nil, the policy never being reloaded.
+func (s *StaticPolicy) Err() error {
+	return nil
+}
+
+// PolicyWatcher is a PolicySource reading the policy from a file, typically a mounted
+// ConfigMap, and swapping in the new policy whenever the file changes. A new policy
+// that fails to parse or validate is rejected and the previous one is kept.
+type PolicyWatcher struct {
+	path     string
+	interval time.Duration
+
+	active  atomic.Value // *ActivePolicy
+	content []byte       // last content read, only accessed by the watching goroutine
+
+	mu  sync.Mutex
+	err error // error of the last reload
+}
+
+// NewPolicyWatcher creates a PolicyWatcher, loading the policy file once.
+// Starting with an invalid policy is an error.
+func NewPolicyWatcher(path string, interval time.Duration) (*PolicyWatcher, error) {
+	w := &PolicyWatcher{path: path, interval: interval}
+	if err := w.Reload(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Current returns the last valid policy.
+func (w *PolicyWatcher) Current() *ActivePolicy {
+	return w.active.Load().(*ActivePolicy)
+}
+
+// Run checks the policy file for changes on every interval until the context is done.
+func (w *PolicyWatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := w.Reload(); err != nil {
+				log.Errorf("Keeping policy version [%s]: %v", w.Current().Version, err)
+			}
+		}
+	}
+}
+
+// Reload reads the policy file and swaps in its policy when the content changed.
+func (w *PolicyWatcher) Reload() error {
+	content, err := os.ReadFile(w.path)
+	if err != nil {
+		// Read again in full once readable, even if unchanged.
+		w.content = nil
+		return w.failed(fmt.Errorf("config: reading policy %s: %w", w.path, err))
+	}
+	if w.content != nil && bytes.Equal(content, w.content) {
+		return nil
+	}
+	w.content = content
+
+	policy := DefaultPolicy()
+	if err := yaml.UnmarshalStrict(content, &policy); err != nil {
+		return w.failed(fmt.Errorf("config: parsing policy %s: %w", w.path, err))
+	}
+	if err := policy.Validate(); err != nil {
+		return w.failed(err)
+	}
+
+	sum := sha256.Sum256(content)
+	active := &ActivePolicy{Policy: policy, Version: hex.EncodeToString(sum[:])[:12], LoadedAt: time.Now()}
+	w.active.Store(active)
+	w.failed(nil)
+	log.Infof("Loaded policy version [%s] from [%s]", active.Version, w.path)
+	return nil
+}
+
+// Err returns the error of the last reload of the policy file, nil once it succeeded.
+func (w *PolicyWatcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// failed records the error of the last reload, and returns it.
+func (w *PolicyWatcher) failed(err error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.err = err
+	return err
+}
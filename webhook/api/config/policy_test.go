@@ -0,0 +1,59 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyWatcherReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policy.yaml")
+	write := func(content string) {
+		require.NoError(t, os.WriteFile(file, []byte(content), 0600))
+	}
+
+	write("namespaces:\n  deployment: develop\n")
+	w, err := NewPolicyWatcher(file, time.Minute)
+	require.NoError(t, err)
+	first := w.Current()
+	require.Equal(t, "develop", first.Namespaces.Deployment)
+	require.Equal(t, DefaultPolicy().Namespaces.Ignored, first.Namespaces.Ignored)
+
+	// Unchanged content keeps the same policy.
+	require.NoError(t, w.Reload())
+	require.Same(t, first, w.Current())
+
+	write("namespaces:\n  deployment: staging\nchecks:\n  scanOnPush: true\n")
+	require.NoError(t, w.Reload())
+	second := w.Current()
+	require.Equal(t, "staging", second.Namespaces.Deployment)
+	require.True(t, second.Checks.ScanOnPush)
+	require.NotEqual(t, first.Version, second.Version)
+
+	// Invalid policies are rejected and the previous one is kept.
+	write("namespaces:\n  deployment: Not_A_Namespace\n")
+	require.Error(t, w.Reload())
+	require.Same(t, second, w.Current())
+	require.NoError(t, w.Reload(), "an unchanged file is not parsed again")
+	require.Error(t, w.Err(), "the rejected policy is still reported")
+
+	write("namespace:\n  deployment: prod\n")
+	require.Error(t, w.Reload())
+	require.Same(t, second, w.Current())
+
+	write("namespaces:\n  deployment: prod\n")
+	require.NoError(t, w.Reload())
+	require.NoError(t, w.Err(), "the error is cleared once a policy is loaded")
+}
+
+func TestNewPolicyWatcherInvalid(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policy.yaml")
+	require.NoError(t, os.WriteFile(file, []byte("namespaces:\n  ignored: [\"\"]\n"), 0600))
+
+	_, err := NewPolicyWatcher(file, time.Minute)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `namespaces.ignored: invalid namespace ""`)
+}
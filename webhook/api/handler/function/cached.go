@@ -0,0 +1,139 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package function
+
+import (
+	"context"
+	"errors"
+	"k8s-update-deployment-ecr-tag/webhook/api/breaker"
+	"k8s-update-deployment-ecr-tag/webhook/api/cache"
+	"k8s-update-deployment-ecr-tag/webhook/api/config"
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/webhook"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+// Names of the caches in the metrics.
+const (
+	ecrCache = "ecr"
+	ssmCache = "ssm"
+)
+
+// NewCaches creates the caches of the ECR and SSM lookups configured; nil when their TTL is zero.
+// Their loads time out after the load timeout; e.g. the one of an admission, the circuit
+// breakers counting the loads timing out as failed.
+func NewCaches(cfg config.Cache, loadTimeout time.Duration) (ecrLookups, ssmLookups *cache.Cache) {
+	if cfg.ECRTTL.Duration > 0 {
+		ecrLookups = cache.New(ecrCache, cfg.ECRTTL.Duration, cfg.NegativeTTL.Duration, loadTimeout, isNotFound)
+	}
+	if cfg.SSMTTL.Duration > 0 {
+		ssmLookups = cache.New(ssmCache, cfg.SSMTTL.Duration, cfg.NegativeTTL.Duration, loadTimeout, isNotFound)
+	}
+	return ecrLookups, ssmLookups
+}
+
+// isNotFound checks that the error is a missing repository, image or parameter,
+// which is cached for the negative TTL.
+func isNotFound(err error) bool {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return false
+	}
+	switch aerr.Code() {
+	case ecr.ErrCodeRepositoryNotFoundException, ecr.ErrCodeImageNotFoundException, ssm.ErrCodeParameterNotFound:
+		return true
+	}
+	return false
+}
+
+// CachedECR is an ECRProvider whose clients cache the repositories and images they describe.
+type CachedECR struct {
+	ECRProvider
+	cache *cache.Cache
+}
+
+// NewCachedECR caches the lookups of the provider's clients.
+func NewCachedECR(provider ECRProvider, lookups *cache.Cache) *CachedECR {
+	return &CachedECR{ECRProvider: provider, cache: lookups}
+}
+
+// ECRFor returns the caching client for the registry.
+func (c *CachedECR) ECRFor(registry webhook.Registry) ecriface.ECRAPI {
+	return &cachedECR{ECRAPI: c.ECRProvider.ECRFor(registry), cache: c.cache, registry: registry.Host}
+}
+
+// cachedECR caches the lookups of an ECR client; the calls it does not override are not cached.
+// The outputs are shared by the callers, which must not modify them.
+type cachedECR struct {
+	ecriface.ECRAPI
+	cache    *cache.Cache
+	registry string
+}
+
+func (c *cachedECR) DescribeRepositoriesWithContext(ctx aws.Context, input *ecr.DescribeRepositoriesInput, opts ...request.Option) (*ecr.DescribeRepositoriesOutput, error) {
+	output, err := c.cache.Get(ctx, c.registry+" DescribeRepositories "+input.String(), func(ctx context.Context) (interface{}, error) {
+		return c.ECRAPI.DescribeRepositoriesWithContext(breaker.Bounded(ctx), input, opts...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.(*ecr.DescribeRepositoriesOutput), nil
+}
+
+func (c *cachedECR) DescribeImagesWithContext(ctx aws.Context, input *ecr.DescribeImagesInput, opts ...request.Option) (*ecr.DescribeImagesOutput, error) {
+	output, err := c.cache.Get(ctx, c.registry+" DescribeImages "+input.String(), func(ctx context.Context) (interface{}, error) {
+		return c.ECRAPI.DescribeImagesWithContext(breaker.Bounded(ctx), input, opts...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.(*ecr.DescribeImagesOutput), nil
+}
+
+// cachedSSM caches the parameters an SSM client reads; the calls it does not override are not cached.
+// The outputs are shared by the callers, which must not modify them.
+type cachedSSM struct {
+	ssmiface.SSMAPI
+	cache *cache.Cache
+	// region distinguishes the parameters of the regional clients.
+	region string
+}
+
+func (c *cachedSSM) GetParameterWithContext(ctx aws.Context, input *ssm.GetParameterInput, opts ...request.Option) (*ssm.GetParameterOutput, error) {
+	output, _, err := c.getParameter(ctx, input, opts...)
+	return output, err
+}
+
+// getParameter reads the parameter, returning when it was read from SSM.
+func (c *cachedSSM) getParameter(ctx aws.Context, input *ssm.GetParameterInput, opts ...request.Option) (*ssm.GetParameterOutput, time.Time, error) {
+	output, loaded, err := c.cache.GetLoaded(ctx, getParameterKey(c.region, input), func(ctx context.Context) (interface{}, error) {
+		return c.SSMAPI.GetParameterWithContext(breaker.Bounded(ctx), input, opts...)
+	})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return output.(*ssm.GetParameterOutput), loaded, nil
+}
+
+func (c *cachedSSM) GetParametersByPathWithContext(ctx aws.Context, input *ssm.GetParametersByPathInput, opts ...request.Option) (*ssm.GetParametersByPathOutput, error) {
+	output, err := c.cache.Get(ctx, c.region+" GetParametersByPath "+input.String(), func(ctx context.Context) (interface{}, error) {
+		return c.SSMAPI.GetParametersByPathWithContext(breaker.Bounded(ctx), input, opts...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.(*ssm.GetParametersByPathOutput), nil
+}
+
+// getParameterKey identifies the parameter read in the region; the default region being empty.
+func getParameterKey(region string, input *ssm.GetParameterInput) string {
+	return region + " GetParameter " + input.String()
+}
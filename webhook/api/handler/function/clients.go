@@ -0,0 +1,115 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package function
+
+import (
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/webhook"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	log "github.com/sirupsen/logrus"
+)
+
+// ECRProvider returns the ECR client able to reach a given registry.
+type ECRProvider interface {
+	ECRFor(registry webhook.Registry) ecriface.ECRAPI
+}
+
+// SSMProvider returns the SSM client for a given region.
+type SSMProvider interface {
+	SSMFor(region string) ssmiface.SSMAPI
+}
+
+// clientKey identifies a cached client. The account is left empty
+// when the webhook's own credentials are used.
+type clientKey struct {
+	account string
+	region  string
+}
+
+// ECRClients builds ECR clients on demand for the registries referenced by images,
+// in the region of each registry. Registries whose account has a configured role
+// are reached by assuming that role, every other registry is reached with the
+// webhook's own credentials.
+type ECRClients struct {
+	sess          *session.Session
+	defaultRegion *string
+	roles         map[string]string // account ID to role ARN
+
+	mu      sync.Mutex
+	clients map[clientKey]ecriface.ECRAPI
+}
+
+// NewECRClients creates a new ECRClients. The default region is used
+// for registries whose region could not be parsed.
+func NewECRClients(sess *session.Session, defaultRegion *string, roles map[string]string) *ECRClients {
+	return &ECRClients{
+		sess:          sess,
+		defaultRegion: defaultRegion,
+		roles:         roles,
+		clients:       make(map[clientKey]ecriface.ECRAPI),
+	}
+}
+
+// ECRFor returns the ECR client for the registry's account and region, creating it on first use.
+func (e *ECRClients) ECRFor(registry webhook.Registry) ecriface.ECRAPI {
+	role, assume := e.roles[registry.AccountID]
+	key := clientKey{region: registry.Region}
+	if assume {
+		key.account = registry.AccountID
+	}
+	if key.region == "" {
+		key.region = aws.StringValue(e.defaultRegion)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if client, ok := e.clients[key]; ok {
+		return client
+	}
+
+	config := &aws.Config{Region: aws.String(key.region)}
+	if assume {
+		// The credentials cache the assumed role session and refresh it before it expires.
+		log.Debugf("Assuming role [%s] for registry account [%s]", role, registry.AccountID)
+		config.Credentials = stscreds.NewCredentials(e.sess, role)
+	}
+	client := ecr.New(e.sess, config)
+	e.clients[key] = client
+	return client
+}
+
+// SSMClients builds SSM clients on demand, one per region.
+type SSMClients struct {
+	sess *session.Session
+
+	mu      sync.Mutex
+	clients map[string]ssmiface.SSMAPI
+}
+
+// NewSSMClients creates a new SSMClients.
+func NewSSMClients(sess *session.Session) *SSMClients {
+	return &SSMClients{
+		sess:    sess,
+		clients: make(map[string]ssmiface.SSMAPI),
+	}
+}
+
+// SSMFor returns the SSM client for the region, creating it on first use.
+func (s *SSMClients) SSMFor(region string) ssmiface.SSMAPI {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if client, ok := s.clients[region]; ok {
+		return client
+	}
+	client := ssm.New(s.sess, &aws.Config{Region: aws.String(region)})
+	s.clients[region] = client
+	return client
+}
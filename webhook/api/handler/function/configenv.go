@@ -0,0 +1,149 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Annotations of the deployments configuring the environment injected from SSM.
+const (
+	// ConfigPathAnnotation is the SSM hierarchy whose parameters are injected; e.g. /gmt/backend.
+	ConfigPathAnnotation = "ecr-tag.brilliantsolutions.com/config-path"
+	// ConfigSecretAnnotation is the Secret, synced from SSM, that SecureString parameters are read from.
+	ConfigSecretAnnotation = "ecr-tag.brilliantsolutions.com/config-secret"
+)
+
+// ErrConfigPathForbidden is returned when the config-path annotation names a hierarchy
+// outside the one of the image's tag parameter, which the deployment may not read.
+var ErrConfigPathForbidden = errors.New("webhook: config path outside the parameters of the image")
+
+// tagParameter is the name of the tag parameter within the hierarchy of a service.
+const tagParameter = "ecr_tag"
+
+// ConfigInjector sets the parameters of the SSM hierarchy the deployment's config-path annotation
+// names as environment variables of the containers running the image; e.g. /gmt/backend/db_host
+// as DB_HOST. SecureString parameters are read from the key of the same name of the
+// config-secret Secret, rather than written in the deployment. The hierarchy must be the
+// one of the image's tag parameter, or below it; e.g. /gmt/backend for gmt-backend images,
+// lest a deployment reads the parameters of others through the webhook's role.
+type ConfigInjector struct {
+	*Container
+}
+
+// Name identifies the plugin.
+func (p *ConfigInjector) Name() string { return "config" }
+
+// Admit injects the parameters of the hierarchy, when the deployment names one.
+func (p *ConfigInjector) Admit(ctx context.Context, a *Admission) Result {
+	hierarchy := a.Deployment.Annotations[ConfigPathAnnotation]
+	if hierarchy == "" {
+		return Result{}
+	}
+	var result Result
+	hierarchy = strings.TrimSuffix(hierarchy, "/")
+	if !strings.HasPrefix(hierarchy, "/") {
+		result.Warn("annotation %s must be an absolute path, got %q, not injecting configuration", ConfigPathAnnotation, hierarchy)
+		return result
+	}
+	if err := allowedHierarchy(a, hierarchy); err != nil {
+		return Deny(err)
+	}
+	parameters, err := p.parametersByPath(ctx, a, hierarchy)
+	if err != nil {
+		return Deny(err)
+	}
+
+	secret := a.Deployment.Annotations[ConfigSecretAnnotation]
+	var env []corev1.EnvVar
+	for _, parameter := range parameters {
+		base := path.Base(aws.StringValue(parameter.Name))
+		if base == tagParameter {
+			continue
+		}
+		name := envName(base)
+		if msgs := validation.IsEnvVarName(name); len(msgs) > 0 {
+			result.Warn("parameter %s is not a valid environment variable, skipping it: %s", aws.StringValue(parameter.Name), strings.Join(msgs, "; "))
+			continue
+		}
+		if aws.StringValue(parameter.Type) != ssm.ParameterTypeSecureString {
+			env = append(env, corev1.EnvVar{Name: name, Value: aws.StringValue(parameter.Value)})
+			continue
+		}
+		if secret == "" {
+			result.Warn("parameter %s is a SecureString and annotation %s is not set, skipping it", aws.StringValue(parameter.Name), ConfigSecretAnnotation)
+			continue
+		}
+		env = append(env, corev1.EnvVar{Name: name, ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: secret}, Key: name},
+		}})
+	}
+	sort.Slice(env, func(i, j int) bool { return env[i].Name < env[j].Name })
+	log.Debugf("Injecting %d parameters of [%s] as environment variables", len(env), hierarchy)
+
+	result.Patch = a.EnvPatches(env...)
+	result.Annotate("config-path", hierarchy)
+	result.Annotate("config-parameters", strconv.Itoa(len(env)))
+	return result
+}
+
+// allowedHierarchy checks that the hierarchy is the one of the image's tag parameter, named
+// by the profile, or below it.
+func allowedHierarchy(a *Admission, hierarchy string) error {
+	repo, _ := parts(a.Image)
+	name, err := reconstruct(a.Profile, repo)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrConfigPathForbidden, err)
+	}
+	allowed := path.Dir(name)
+	if path.Clean(hierarchy) != hierarchy || (hierarchy != allowed && !strings.HasPrefix(hierarchy, allowed+"/")) {
+		return fmt.Errorf("%w: annotation %s must be %s or below it, got %q", ErrConfigPathForbidden, ConfigPathAnnotation, allowed, hierarchy)
+	}
+	return nil
+}
+
+// parametersByPath returns the parameters directly under the hierarchy, without decrypting them.
+func (p *ConfigInjector) parametersByPath(ctx context.Context, a *Admission, hierarchy string) ([]*ssm.Parameter, error) {
+	input := &ssm.GetParametersByPathInput{Path: aws.String(hierarchy), WithDecryption: aws.Bool(false)}
+	var parameters []*ssm.Parameter
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		output, err := p.SSMClient.For(a.Registry).GetParametersByPathWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		parameters = append(parameters, output.Parameters...)
+		if aws.StringValue(output.NextToken) == "" {
+			return parameters, nil
+		}
+		input.NextToken = output.NextToken
+	}
+}
+
+// envName returns the environment variable of a parameter; e.g. db-host gives DB_HOST.
+func envName(parameter string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		}
+		return '_'
+	}, parameter)
+}
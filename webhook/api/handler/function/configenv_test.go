@@ -0,0 +1,119 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"k8s-update-deployment-ecr-tag/webhook/api/config"
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/webhook"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// fakeHierarchy serves the parameters of a path, one per page.
+type fakeHierarchy struct {
+	ssmiface.SSMAPI
+	parameters map[string][]*ssm.Parameter
+}
+
+func (f *fakeHierarchy) GetParametersByPathWithContext(_ aws.Context, input *ssm.GetParametersByPathInput, _ ...request.Option) (*ssm.GetParametersByPathOutput, error) {
+	parameters := f.parameters[aws.StringValue(input.Path)]
+	page := 0
+	if input.NextToken != nil {
+		page, _ = strconv.Atoi(aws.StringValue(input.NextToken))
+	}
+	output := &ssm.GetParametersByPathOutput{}
+	if page < len(parameters) {
+		output.Parameters = parameters[page : page+1]
+	}
+	if page+1 < len(parameters) {
+		output.NextToken = aws.String(strconv.Itoa(page + 1))
+	}
+	return output, nil
+}
+
+func TestConfigInjector(t *testing.T) {
+	const host = "123456789012.dkr.ecr.eu-west-3.amazonaws.com"
+	parameter := func(name, kind, value string) *ssm.Parameter {
+		return &ssm.Parameter{Name: aws.String(name), Type: aws.String(kind), Value: aws.String(value)}
+	}
+	c := &Container{SSMClient: *NewSSMClient(&fakeHierarchy{parameters: map[string][]*ssm.Parameter{
+		"/gmt/backend": {
+			parameter("/gmt/backend/ecr_tag", ssm.ParameterTypeString, "5d1a9c2"),
+			parameter("/gmt/backend/log-level", ssm.ParameterTypeString, "info"),
+			parameter("/gmt/backend/db_password", ssm.ParameterTypeSecureString, "encrypted"),
+			parameter("/gmt/backend/2fa", ssm.ParameterTypeString, "on"),
+		},
+	}})}
+	deployment := func(annotations map[string]string) *appsv1.Deployment {
+		d := &appsv1.Deployment{}
+		d.Annotations = annotations
+		d.Spec.Template.Spec.Containers = []corev1.Container{{Name: "web", Image: host + "/gmt-backend:old"}}
+		return d
+	}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        string
+		warnings    int
+		wantErr     bool
+	}{
+		{"NotAnnotated", nil, `null`, 0, false},
+		{"Secret", map[string]string{ConfigPathAnnotation: "/gmt/backend/", ConfigSecretAnnotation: "gmt-backend"}, `[
+			{"op": "add", "path": "/spec/template/spec/containers/0/env", "value": [
+				{"name": "DB_PASSWORD", "valueFrom": {"secretKeyRef": {"name": "gmt-backend", "key": "DB_PASSWORD"}}},
+				{"name": "LOG_LEVEL", "value": "info"}
+			]},
+			{"op": "add", "path": "/spec/template/spec/containers/0/env/-", "value": {"name": "APP_VERSION", "value": "5d1a9c2"}}
+		]`, 1, false},
+		{"NoSecret", map[string]string{ConfigPathAnnotation: "/gmt/backend"}, `[
+			{"op": "add", "path": "/spec/template/spec/containers/0/env", "value": [{"name": "LOG_LEVEL", "value": "info"}]},
+			{"op": "add", "path": "/spec/template/spec/containers/0/env/-", "value": {"name": "APP_VERSION", "value": "5d1a9c2"}}
+		]`, 2, false},
+		{"RelativePath", map[string]string{ConfigPathAnnotation: "gmt/backend"}, `null`, 1, false},
+		{"BelowHierarchy", map[string]string{ConfigPathAnnotation: "/gmt/backend/worker"}, `null`, 0, false},
+		{"OtherHierarchy", map[string]string{ConfigPathAnnotation: "/gmt/frontend"}, `null`, 0, true},
+		{"ParentHierarchy", map[string]string{ConfigPathAnnotation: "/gmt"}, `null`, 0, true},
+		{"SiblingPrefix", map[string]string{ConfigPathAnnotation: "/gmt/backend-admin"}, `null`, 0, true},
+		{"Traversal", map[string]string{ConfigPathAnnotation: "/gmt/backend/../frontend"}, `null`, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			admission := &Admission{
+				Deployment: deployment(tt.annotations),
+				Profile: config.Profile{
+					NamingTemplate:  config.DefaultNamingTemplate,
+					ParameterPrefix: config.DefaultParameterPrefix,
+					Version:         config.VersionInjection{EnvVar: "APP_VERSION"},
+				},
+				Registry:   webhook.Registry{Host: host},
+				Image:      "gmt-backend:old",
+				Resolution: &Resolution{Tag: "5d1a9c2"},
+			}
+			// The version is injected after the configuration, without overwriting its env list.
+			result := (&ConfigInjector{Container: c}).Admit(context.Background(), admission)
+			if tt.wantErr {
+				require.ErrorIs(t, result.Err, ErrConfigPathForbidden)
+				require.Equal(t, config.ErrorPolicyViolation, Classify(result.Err))
+				return
+			}
+			require.NoError(t, result.Err)
+			require.Len(t, result.Warnings, tt.warnings)
+			patch := result.Patch
+			if tt.annotations != nil && result.Patch != nil {
+				patch = append(patch, (&VersionInjector{}).Admit(context.Background(), admission).Patch...)
+			}
+			got, err := json.Marshal(patch)
+			require.NoError(t, err)
+			require.JSONEq(t, tt.want, string(got))
+		})
+	}
+}
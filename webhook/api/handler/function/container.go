@@ -7,13 +7,24 @@ package function
 import (
 	"context"
 	"errors"
+	"fmt"
+	"k8s-update-deployment-ecr-tag/webhook/api/audit"
+	"k8s-update-deployment-ecr-tag/webhook/api/config"
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/tagpolicy"
 	"k8s-update-deployment-ecr-tag/webhook/api/handler/webhook"
+	"k8s-update-deployment-ecr-tag/webhook/api/metrics"
+	"k8s-update-deployment-ecr-tag/webhook/api/tracing"
 	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
 
-	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
 	v1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
 )
 
 // Errors returned when a validation expectation fails.
@@ -25,16 +36,66 @@ var (
 
 // Container contains the dependencies and business logic for the amazon-ecr-repository-compliance-webhook Lambda function.
 type Container struct {
-	ECR       ecriface.ECRAPI
+	ECR       ECRProvider
 	SSMClient SSMClient
+	// Policies provides the policy applied to each admission.
+	Policies config.PolicySource
+	// Namespaces provides the labels of namespaces matched by namespace selectors.
+	Namespaces webhook.NamespaceLister
+	// TagPolicies, when set, provides the TagPolicy overriding the profile of a deployment.
+	TagPolicies TagPolicyLister
+	// Replication, when set, rewrites images to the replica of their registry.
+	Replication *Replication
+	// PullThrough, when set, rewrites non ECR images to pull-through cache repositories.
+	PullThrough *PullThroughCache
+	// LastKnown remembers the resolved tags, for failures allowing admissions with the last known tag.
+	LastKnown *LastKnownTags
+	// Clock, when set, replaces time.Now to date the resolutions.
+	Clock func() time.Time
+	// Plugins are the steps admissions go through, in order; NewContainer sets the DefaultPlugins.
+	Plugins []Plugin
+	// Decisions, when set, logs the decision of each admission.
+	Decisions *DecisionLog
+	// Audit, when set, keeps the trail of the decisions, but those of dry runs.
+	Audit AuditTrail
+
+	// revalidating holds the keys of the parameters revalidated in the background.
+	revalidating sync.Map
+}
+
+// AuditTrail keeps the decisions of the admissions; e.g. an audit.Store.
+type AuditTrail interface {
+	Append(record audit.Record) error
+}
+
+// TagPolicyLister provides the TagPolicy applying to a deployment, nil when none does.
+type TagPolicyLister interface {
+	For(deployment *appsv1.Deployment) (*tagpolicy.TagPolicy, error)
 }
 
 // NewContainer creates a new function Container.
-func NewContainer(ecrSvc ecriface.ECRAPI, ssmSvc ssmiface.SSMAPI) *Container {
-	return &Container{
+func NewContainer(cfg *config.Config, ecrSvc ECRProvider, ssmSvc ssmiface.SSMAPI) *Container {
+	c := &Container{
 		ECR:       ecrSvc,
 		SSMClient: *NewSSMClient(ssmSvc),
+		Policies:  config.NewStaticPolicy(cfg.Policy),
+		LastKnown: NewLastKnownTags(),
+		Decisions: NewDecisionLog(cfg.Log.DecisionSampleRatio),
+	}
+	c.LastKnown.MaxStaleness = cfg.LastKnownTags.MaxStaleness.Duration
+	c.Plugins = c.DefaultPlugins()
+	ecrLookups, ssmLookups := NewCaches(cfg.Cache, cfg.Server.AdmissionTimeout.Duration)
+	if ecrLookups != nil {
+		c.ECR = NewCachedECR(ecrSvc, ecrLookups)
 	}
+	c.SSMClient.Cache = ssmLookups
+	if cfg.Replication.Enabled() {
+		c.Replication = &Replication{Region: cfg.Replication.Region, Registries: cfg.Replication.Registries}
+	}
+	if cfg.PullThrough.Enabled() {
+		c.PullThrough = &PullThroughCache{Prefixes: cfg.PullThrough.Prefixes, Enforce: cfg.PullThrough.Enforce}
+	}
+	return c
 }
 
 // default HTTP status code to return on rejected admission
@@ -45,71 +106,196 @@ const parameterCode = 407 // ParameterNotFound
 // 1. Extract the POST request's body that ValidatingWebhookConfiguration admission controller made to API Gateway
 // 2. Using the request, create a response. The response must contain the same UID that we received from the cluster
 // 3. Using the request, extract the deployment object into the same Go data type used by Kubernetes
-// 4. Using the deployment, check if the requested creation namespace is a critical one (e.g. default).
+// 4. Using the deployment, check if the policy mutates its namespace and labels; critical ones (e.g. kube-system) never are.
+//   - The profile of its environment applies, overridden by the TagPolicy of its namespace selecting it
+//
 // 5. Using the deployment, extract all of the unique container images that are in the specification
+//   - Images from other registries are rewritten to their pull-through cache, when configured
 //   - If no images in the specification come from ECR, deny the admission immediately
 //
-// 6. For every image provided, check our 4 requirements
-// 7. If a single image didn't meet our requirements, deny the admission
-// 8. All requirements satisfied, allow the deployment for admission
+// 6. Using the registry of the images, prepare the admission of the deployment's image
+// 7. Run the admission through the plugins, by default checking then resolving the image; the first failing ends it
+// 8. Every plugin passed, allow the deployment for admission with their patches merged
+//
+// In audit mode, the admission is allowed unmodified and the outcome it would
+// have had is reported in its warnings and audit annotations instead.
+//
+// Failures to check or resolve an image take the action the profile chooses for their error
+// class, and panics deny the admission instead of failing the request.
 func (c *Container) Handler() Handler {
-	return func(ctx context.Context, event *http.Request) (*v1.AdmissionReview, error) {
-		request, err := webhook.NewRequestFromEvent(event) // 1
+	return func(ctx context.Context, event *http.Request) (review *v1.AdmissionReview, err error) {
+		var (
+			request    *webhook.Request
+			response   *webhook.Response
+			deployment *appsv1.Deployment
+			start      = time.Now()
+		)
+		ctx, span := tracing.Start(ctx, "admission")
+		defer span.End()
+		defer func() { c.record(ctx, request, response, deployment, review, time.Since(start)) }()
+		logger := log.WithContext(ctx)
+
+		_, decode := tracing.Start(ctx, "decode review")
+		request, err = webhook.NewRequestFromEvent(event) // 1
+		decode.End()
 		if err != nil {
-			log.Errorf("Error creating request from event: %v", err)
+			logger.Errorf("Error creating request from event: %v", err)
+			tracing.Fail(span, err)
 			return webhook.BadRequestResponse(err)
 		}
 
-		response, err := webhook.NewResponseFromRequest(request) // 2
+		response, err = webhook.NewResponseFromRequest(request) // 2
 		if err != nil {
-			log.Errorf("Error crafting response from request: %v", err)
+			logger.Errorf("Error crafting response from request: %v", err)
+			tracing.Fail(span, err)
 			return webhook.BadRequestResponse(err)
 		}
+		span.SetAttributes(tracing.AdmissionUID.String(string(request.Admission.UID)), tracing.Namespace.String(request.Admission.Namespace))
+		defer func() {
+			if p := recover(); p != nil {
+				logger.Errorf("Recovered from panic: %v\n%s", p, debug.Stack())
+				review, err = response.FailValidation(http.StatusInternalServerError, fmt.Errorf("webhook: internal error: %v", p))
+			}
+			if failure := response.Failure(); failure != nil {
+				tracing.Fail(span, failure)
+			}
+		}()
+
+		policy := c.Policies.Current()
+		logger.Debugf("Applying policy version [%s]", policy.Version)
 
-		deployment, err := request.UnmarshalDeployment() // 3
+		_, decode = tracing.Start(ctx, "decode deployment")
+		deployment, err = request.UnmarshalDeployment() // 3
+		decode.End()
 		if err != nil {
-			log.Errorf("Error unmarshalling Deployment: %v", err)
+			logger.Errorf("Error unmarshalling Deployment: %v", err)
 			return response.FailValidation(code, err)
 		}
+		span.SetAttributes(tracing.Deployment.String(deployment.Name))
 
-		if webhook.InCriticalNamespace(deployment) { // 4
-			log.Info("Deployment is in critical namespace, automatically passing")
-			return response.PassValidation(""), nil
-		}
-
-		if webhook.NotInDeploymentNamespace(deployment) { // 5
-			log.Info("Deployment is not in the deployment namespaces, automatically passing")
-			return response.PassValidation(""), nil
-		}
-
-		registry, images := webhook.ParseImages(deployment) // 6
-		if len(images) == 0 {
-			log.Error(ErrImagesNotFound)
-			return response.FailValidation(code, ErrImagesNotFound)
+		inScope, reason, err := webhook.InScope(deployment, policy.Policy, c.Namespaces) // 4, 5
+		if err != nil {
+			logger.Errorf("Error matching the policy's namespaces: %v", err)
+			return response.FailValidation(code, err)
 		}
-		if len(images) > 1 {
-			log.Error(ErrMultiImagesNotSuppported)
-			return response.FailValidation(code, ErrMultiImagesNotSuppported)
+		if !inScope {
+			logger.Infof("%s, automatically passing", reason)
+			return response.PassValidation()
 		}
 
-		compliant, err := c.BatchCheckRepositoryCompliance(ctx, images) // 7
+		profile, err := webhook.ProfileFor(deployment, policy.Policy, c.Namespaces)
 		if err != nil {
-			log.Errorf("Error during compliance check: %v", err)
+			logger.Errorf("Error matching the policy's environments: %v", err)
 			return response.FailValidation(code, err)
 		}
+		if c.TagPolicies != nil {
+			tagPolicy, err := c.TagPolicies.For(deployment)
+			if err != nil {
+				logger.Errorf("Error listing the namespace's tag policies: %v", err)
+				return response.FailValidation(code, err)
+			}
+			if tagPolicy != nil {
+				profile = tagPolicy.Apply(profile)
+			}
+		}
+		logger.Debugf("Applying the profile of environment [%s] and tag policy [%s]", profile.Environment, profile.TagPolicy)
 
-		if !compliant { // 8
-			log.Error("Repository is not compliant")
-			return response.FailValidation(code, ErrFailedCompliance)
+		review, err = c.mutate(ctx, response, deployment, profile)
+		if err != nil || profile.Mode != config.ModeAudit {
+			return review, err
 		}
+		metrics.ObserveAudit(response.Admission.Allowed, len(response.Patch()))
+		logger.Infof("Auditing deployment [%s/%s], allowed unmodified", deployment.Namespace, deployment.Name)
+		return response.Audit(), nil
+	}
+}
 
-		// Now we only need to check for one repository, later it maybe more
-		newImages, err := c.BatchUpdateImage(ctx, registry, images)
-		if err != nil { // 9
-			log.Errorf("Error during paramter fetching: %v", err)
-			return response.FailValidation(parameterCode, err)
+// record observes the reviewed admission in the metrics and logs its decision; the request
+// and response are nil when the admission was a bad request, and the deployment when it
+// could not be decoded.
+func (c *Container) record(ctx context.Context, request *webhook.Request, response *webhook.Response, deployment *appsv1.Deployment, review *v1.AdmissionReview, duration time.Duration) {
+	if review == nil || review.Response == nil {
+		return
+	}
+	a := metrics.Admission{Outcome: metrics.OutcomeAllowed, Duration: duration}
+	if request != nil && request.Admission != nil {
+		a.Namespace, a.Kind, a.Operation = request.Admission.Namespace, request.Admission.Kind.Kind, string(request.Admission.Operation)
+	}
+	switch {
+	case review.Response.AuditAnnotations["mode"] == "audit":
+		a.Outcome = metrics.OutcomeAudited
+	case !review.Response.Allowed:
+		a.Outcome, a.Reason = metrics.OutcomeDenied, denialReason(response)
+	case len(review.Response.Patch) > 0:
+		a.Outcome, a.PatchOperations = metrics.OutcomePatched, len(response.Patch())
+	}
+	metrics.ObserveAdmission(a)
+	d := Decision{Admission: a, Request: request, Response: response, Deployment: deployment, Review: review}
+	if c.Decisions != nil {
+		c.Decisions.Log(ctx, d)
+	}
+	if c.Audit != nil && request != nil && request.Admission != nil && !aws.BoolValue(request.Admission.DryRun) {
+		if err := c.Audit.Append(d.Record()); err != nil {
+			log.WithContext(ctx).Errorf("Error auditing the decision: %v", err)
 		}
+	}
+}
+
+// denialReason names the reason of a denial in the metrics: the error class of
+// failures to check or resolve the image, otherwise the failure of the admission.
+func denialReason(response *webhook.Response) string {
+	if response == nil {
+		return "badRequest"
+	}
+	if class, ok := response.Admission.AuditAnnotations["error-class"]; ok {
+		return class
+	}
+	switch failure := response.Failure(); {
+	case errors.Is(failure, ErrImagesNotFound):
+		return "imagesNotFound"
+	case errors.Is(failure, ErrMultiImagesNotSuppported):
+		return "multipleImages"
+	case errors.Is(failure, ErrPublicImages):
+		return "publicImages"
+	case response.Admission.Result != nil && response.Admission.Result.Code == http.StatusInternalServerError:
+		return "internalError"
+	}
+	return "invalidDeployment"
+}
+
+// mutate checks and resolves the images of the deployment, and responds with their patch.
+func (c *Container) mutate(ctx context.Context, response *webhook.Response, deployment *appsv1.Deployment, profile config.Profile) (*v1.AdmissionReview, error) {
+	logger := log.WithContext(ctx)
+	pullThrough, err := c.PullThroughPatches(deployment)
+	if err != nil {
+		logger.Errorf("Error rewriting images to pull-through caches: %v", err)
+		return response.FailValidation(code, err)
+	}
+
+	registry, images := webhook.ParseImages(deployment) // 6
+	images = c.taggedImages(registry, images)
+	if len(images) == 0 && len(pullThrough) > 0 {
+		logger.Info("Deployment only contains images pulled through caches, passing")
+		return response.PassValidation(pullThrough...)
+	}
+	if len(images) == 0 {
+		logger.Error(ErrImagesNotFound)
+		return response.FailValidation(code, ErrImagesNotFound)
+	}
+	if len(images) > 1 {
+		logger.Error(ErrMultiImagesNotSuppported)
+		return response.FailValidation(code, ErrMultiImagesNotSuppported)
+	}
 
-		return response.PassValidation(newImages[0]), nil // 10
+	ecrRegistry, err := webhook.ParseRegistry(registry)
+	if err != nil {
+		logger.Errorf("Error parsing registry [%s]: %v", registry, err)
+		return response.FailValidation(code, err)
 	}
+
+	repo, _ := parts(images[0])
+	trace.SpanFromContext(ctx).SetAttributes(tracing.Repository.String(repo))
+
+	admission := &Admission{Deployment: deployment, Profile: profile, Registry: ecrRegistry, Image: images[0]}
+	return c.admit(ctx, response, admission, mutation{deployment: deployment, registry: ecrRegistry, image: images[0], patch: pullThrough}) // 7, 8
 }
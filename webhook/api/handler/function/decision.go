@@ -0,0 +1,170 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package function
+
+import (
+	"context"
+	"k8s-update-deployment-ecr-tag/webhook/api/audit"
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/webhook"
+	"k8s-update-deployment-ecr-tag/webhook/api/metrics"
+	"math/rand"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+)
+
+// DecisionLog logs the decision of each admission as a single structured record.
+type DecisionLog struct {
+	// SampleRatio is the ratio of the allowed admissions logged; denied ones always are.
+	SampleRatio float64
+	// sample returns a number in [0, 1); e.g. rand.Float64.
+	sample func() float64
+}
+
+// NewDecisionLog creates a DecisionLog logging the ratio of the allowed admissions.
+func NewDecisionLog(sampleRatio float64) *DecisionLog {
+	return &DecisionLog{SampleRatio: sampleRatio, sample: rand.Float64}
+}
+
+// Decision is what the webhook decided for an admission, along with what it was decided on.
+type Decision struct {
+	metrics.Admission
+	Request  *webhook.Request
+	Response *webhook.Response
+	// Deployment is the admitted deployment; nil when it could not be decoded.
+	Deployment *appsv1.Deployment
+	Review     *v1.AdmissionReview
+}
+
+// Log logs the decision, unless it allowed the admission and is not sampled. The record
+// holds no environment variable value: the patch logged is redacted.
+func (l *DecisionLog) Log(ctx context.Context, d Decision) {
+	if d.Outcome != metrics.OutcomeDenied && l.SampleRatio < 1 && l.sample() >= l.SampleRatio {
+		return
+	}
+	fields := log.Fields{
+		"outcome":    d.Outcome,
+		"latency_ms": float64(d.Duration) / float64(time.Millisecond),
+	}
+	if d.Request != nil && d.Request.Admission != nil {
+		a := d.Request.Admission
+		fields["uid"] = a.UID
+		fields["namespace"] = a.Namespace
+		fields["name"] = a.Name
+		fields["kind"] = a.Kind.Kind
+		fields["operation"] = a.Operation
+		fields["user"] = a.UserInfo.Username
+	}
+	if d.Deployment != nil {
+		if fields["name"] == "" {
+			fields["name"] = d.Deployment.Name
+		}
+		before := containerImages(d.Deployment)
+		fields["images_before"] = before
+		fields["images_after"] = before
+		if len(d.Review.Response.Patch) > 0 {
+			fields["images_after"] = patchedImages(d.Deployment, d.Response.Patch())
+		}
+	}
+	if d.Response != nil {
+		annotations := d.Response.Admission.AuditAnnotations
+		for key, field := range decisionAnnotations {
+			if value, ok := annotations[key]; ok {
+				fields[field] = value
+			}
+		}
+		if len(d.Review.Response.Patch) > 0 {
+			fields["patch"] = webhook.RedactPatch(d.Response.Patch())
+		}
+		if len(d.Response.Admission.Warnings) > 0 {
+			fields["warnings"] = d.Response.Admission.Warnings
+		}
+	}
+	if d.Outcome == metrics.OutcomeDenied {
+		fields["reason"] = d.Reason
+	}
+	if result := d.Review.Response.Result; result != nil {
+		fields["message"] = result.Message
+	}
+
+	entry := log.WithContext(ctx).WithFields(fields)
+	if d.Outcome == metrics.OutcomeDenied {
+		entry.Warn("Admission decided")
+		return
+	}
+	entry.Info("Admission decided")
+}
+
+// Record returns the audit record of the decision.
+func (d Decision) Record() audit.Record {
+	r := audit.Record{Outcome: d.Outcome, Reason: d.Reason}
+	if d.Request != nil && d.Request.Admission != nil {
+		a := d.Request.Admission
+		r.UID, r.Namespace, r.Name = string(a.UID), a.Namespace, a.Name
+		r.Kind, r.Operation, r.User = a.Kind.Kind, string(a.Operation), a.UserInfo.Username
+	}
+	if d.Deployment != nil {
+		if r.Name == "" {
+			r.Name = d.Deployment.Name
+		}
+		r.ImagesBefore = containerImages(d.Deployment)
+		r.ImagesAfter = r.ImagesBefore
+		if len(d.Review.Response.Patch) > 0 {
+			r.ImagesAfter = patchedImages(d.Deployment, d.Response.Patch())
+		}
+		_, images := webhook.ParseImages(d.Deployment)
+		for _, image := range images {
+			repo, _ := parts(image)
+			r.Repositories = append(r.Repositories, repo)
+		}
+	}
+	if d.Response != nil {
+		annotations := d.Response.Admission.AuditAnnotations
+		r.TagSource, r.Parameter, r.ParameterVersion = annotations["tag-source"], annotations["parameter"], annotations["parameter-version"]
+		r.Checks, r.Environment, r.Action = annotations["checks"], annotations["environment"], annotations["action"]
+		r.Warnings = d.Response.Admission.Warnings
+	}
+	if result := d.Review.Response.Result; result != nil {
+		r.Message = result.Message
+	}
+	return r
+}
+
+// decisionAnnotations maps the audit annotations explaining a decision to the fields logging them.
+var decisionAnnotations = map[string]string{
+	"tag-source":        "tag_source",
+	"parameter":         "parameter",
+	"parameter-version": "parameter_version",
+	"checks":            "checks",
+	"environment":       "environment",
+	"tag-policy":        "tag_policy",
+	"error-class":       "error_class",
+	"action":            "action",
+	"mode":              "mode",
+}
+
+// containerImages returns the image of each container of the deployment, by container.
+func containerImages(deployment *appsv1.Deployment) map[string]string {
+	images := make(map[string]string)
+	for _, c := range webhook.ContainerImages(deployment) {
+		images[c.Name] = c.Image
+	}
+	return images
+}
+
+// patchedImages returns the image of each container of the deployment once patched.
+func patchedImages(deployment *appsv1.Deployment, patch []webhook.PatchOperation) map[string]string {
+	images := make(map[string]string)
+	for _, c := range webhook.ContainerImages(deployment) {
+		images[c.Name] = c.Image
+		for _, op := range patch {
+			if image, ok := op.Value.(string); ok && op.Path == c.Path && op.Op == "replace" {
+				images[c.Name] = image
+			}
+		}
+	}
+	return images
+}
@@ -0,0 +1,101 @@
+package function
+
+import (
+	"context"
+	"k8s-update-deployment-ecr-tag/webhook/api/audit"
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/webhook"
+	"k8s-update-deployment-ecr-tag/webhook/api/metrics"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestDecisionLog(t *testing.T) {
+	hook := test.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	const host = "123456789012.dkr.ecr.eu-west-3.amazonaws.com"
+	deployment := &appsv1.Deployment{}
+	deployment.Name = "gmt-backend"
+	deployment.Spec.Template.Spec.Containers = []corev1.Container{{Name: "web", Image: host + "/gmt-backend:latest"}}
+	request := &webhook.Request{Admission: &v1.AdmissionRequest{
+		UID:       "705ab4f5",
+		Namespace: "develop",
+		Operation: v1.Create,
+		UserInfo:  authenticationv1.UserInfo{Username: "system:serviceaccount:ci:deployer"},
+	}}
+	decide := func(patch ...webhook.PatchOperation) Decision {
+		response, _ := webhook.NewResponseFromRequest(request)
+		response.Annotate("tag-source", "ssm")
+		review, _ := response.PassValidation(patch...)
+		return Decision{Admission: metrics.Admission{Outcome: metrics.OutcomePatched}, Request: request, Response: response, Deployment: deployment, Review: review}
+	}
+	patched := decide(
+		webhook.ReplaceImage("/spec/template/spec/containers/0/image", host+"/gmt-backend:5d1a9c2"),
+		webhook.PatchOperation{Op: "add", Path: "/spec/template/spec/containers/0/env", Value: []corev1.EnvVar{{Name: "API_KEY", Value: "s3cr3t"}}},
+	)
+
+	l := NewDecisionLog(1)
+	l.Log(context.Background(), patched)
+	require.Len(t, hook.AllEntries(), 1)
+	entry := hook.LastEntry()
+	require.Equal(t, log.InfoLevel, entry.Level)
+	require.Equal(t, "gmt-backend", entry.Data["name"])
+	require.Equal(t, "system:serviceaccount:ci:deployer", entry.Data["user"])
+	require.Equal(t, "ssm", entry.Data["tag_source"])
+	require.Equal(t, map[string]string{"web": host + "/gmt-backend:latest"}, entry.Data["images_before"])
+	require.Equal(t, map[string]string{"web": host + "/gmt-backend:5d1a9c2"}, entry.Data["images_after"])
+	require.NotContains(t, entry.Data["patch"].([]webhook.PatchOperation)[1].Value.([]corev1.EnvVar)[0].Value, "s3cr3t")
+
+	hook.Reset()
+	l = &DecisionLog{SampleRatio: 0.5, sample: func() float64 { return 0.7 }}
+	l.Log(context.Background(), patched)
+	require.Empty(t, hook.AllEntries(), "the allowed admission is not sampled")
+
+	response, _ := webhook.NewResponseFromRequest(request)
+	review, _ := response.FailValidation(code, ErrImagesNotFound)
+	l.Log(context.Background(), Decision{Admission: metrics.Admission{Outcome: metrics.OutcomeDenied, Reason: "imagesNotFound"}, Request: request, Response: response, Deployment: deployment, Review: review})
+	require.Len(t, hook.AllEntries(), 1, "denied admissions are always logged")
+	require.Equal(t, log.WarnLevel, hook.LastEntry().Level)
+	require.Equal(t, "imagesNotFound", hook.LastEntry().Data["reason"])
+}
+
+// trail keeps the records appended.
+type trail []audit.Record
+
+func (t *trail) Append(r audit.Record) error {
+	*t = append(*t, r)
+	return nil
+}
+
+func TestAuditTrail(t *testing.T) {
+	const host = "123456789012.dkr.ecr.eu-west-3.amazonaws.com"
+	deployment := &appsv1.Deployment{}
+	deployment.Name = "gmt-backend"
+	deployment.Spec.Template.Spec.Containers = []corev1.Container{{Name: "web", Image: host + "/gmt-backend:latest"}}
+	records := &trail{}
+	c := &Container{Audit: records}
+
+	for _, dryRun := range []bool{false, true} {
+		request := &webhook.Request{Admission: &v1.AdmissionRequest{UID: "705ab4f5", Namespace: "develop", DryRun: &dryRun}}
+		response, _ := webhook.NewResponseFromRequest(request)
+		response.Annotate("parameter", "/gmt/backend/ecr_tag")
+		review, _ := response.PassValidation(webhook.ReplaceImage("/spec/template/spec/containers/0/image", host+"/gmt-backend:5d1a9c2"))
+		c.record(context.Background(), request, response, deployment, review, time.Millisecond)
+	}
+
+	require.Len(t, *records, 1, "dry runs are not audited")
+	r := (*records)[0]
+	require.Equal(t, "gmt-backend", r.Name)
+	require.Equal(t, metrics.OutcomePatched, r.Outcome)
+	require.Equal(t, []string{"gmt-backend"}, r.Repositories)
+	require.Equal(t, "/gmt/backend/ecr_tag", r.Parameter)
+	require.Equal(t, host+"/gmt-backend:5d1a9c2", r.ImagesAfter["web"])
+}
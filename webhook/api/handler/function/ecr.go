@@ -6,6 +6,9 @@ package function
 import (
 	"context"
 	"fmt"
+	"k8s-update-deployment-ecr-tag/webhook/api/config"
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/webhook"
+	"k8s-update-deployment-ecr-tag/webhook/api/tracing"
 	"strings"
 	"sync"
 
@@ -13,6 +16,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/aws/aws-sdk-go/service/ssm"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -27,53 +31,60 @@ func parts(image string) (repo, tagOrDigest string) {
 		log.Tracef("parts: repo [%s], tagOrHash [%s]", repo, tagOrDigest)
 		return
 	}
-	segments := strings.Split(image, ":")
-	repo, tagOrDigest = segments[0], segments[1]
+	segments := strings.SplitN(image, ":", 2)
+	repo = segments[0]
+	if len(segments) == 2 {
+		tagOrDigest = segments[1]
+	}
 	log.Tracef("parts: repo [%s], tagOrHash [%s]", repo, tagOrDigest)
 	return
 }
 
 // CheckRepositoryCompliance checks if the container image that was sent to the webhook:
 // 1. Comes from an ECR repository
-// 2. Has image tag immutability enabled
-// 3. Has image scan on push enabled
-// 4. Does not contain any critical vulnerabilities
-func (c *Container) CheckRepositoryCompliance(ctx context.Context, image string) (bool, error) {
+// 2. Has image tag immutability enabled, when enforced
+// 3. Has image scan on push enabled, when enforced
+// 4. Does not contain any critical vulnerabilities, when enforced
+func (c *Container) CheckRepositoryCompliance(ctx context.Context, registry webhook.Registry, image string, checks config.Checks) (_ bool, err error) {
 	repo, _ := parts(image)
+	ctx, span := tracing.Start(ctx, "compliance check", tracing.Repository.String(repo))
+	defer tracing.End(span, &err)
 	input := &ecr.DescribeRepositoriesInput{
+		RegistryId:      aws.String(registry.AccountID),
 		RepositoryNames: []*string{aws.String(repo)},
 	}
 	if err := input.Validate(); err != nil {
 		return false, err
 	}
-	output, err := c.ECR.DescribeRepositoriesWithContext(ctx, input)
+	output, err := c.ECR.ECRFor(registry).DescribeRepositoriesWithContext(ctx, input)
 	if err != nil {
 		return false, err
 	}
 	if len(output.Repositories) == 0 {
-		return false, fmt.Errorf("no repositories named '%s' found", repo)
-	}
-	// r := output.Repositories[0]
-	// Deactivate those checks for now, maybe needed later, TODO: Activate Tag immutability, ScanOnPush and CriticalVulnerabilities checks for kubenetes admission controller
-	// if aws.StringValue(r.ImageTagMutability) == ecr.ImageTagMutabilityMutable {
-	// 	return false, fmt.Errorf("repository '%s' does not have image tag immutability enabled", repo)
-	// }
-	// if !aws.BoolValue(r.ImageScanningConfiguration.ScanOnPush) {
-	// 	return false, fmt.Errorf("repository '%s' does not have image scan on push enabled", repo)
-	// }
-	// critical, err := c.HasCriticalVulnerabilities(ctx, image)
-	// if err != nil {
-	// 	return false, err
-	// }
-	// if critical {
-	// 	return false, fmt.Errorf("image '%s' contains %s vulnerabilities", image, ecr.FindingSeverityCritical)
-	// }
+		return false, fmt.Errorf("%w: %s", ErrRepositoryNotFound, repo)
+	}
+	r := output.Repositories[0]
+	if checks.TagImmutability && aws.StringValue(r.ImageTagMutability) == ecr.ImageTagMutabilityMutable {
+		return false, fmt.Errorf("%w: repository '%s' does not have image tag immutability enabled", ErrFailedCompliance, repo)
+	}
+	if checks.ScanOnPush && (r.ImageScanningConfiguration == nil || !aws.BoolValue(r.ImageScanningConfiguration.ScanOnPush)) {
+		return false, fmt.Errorf("%w: repository '%s' does not have image scan on push enabled", ErrFailedCompliance, repo)
+	}
+	if checks.CriticalVulnerabilities {
+		critical, err := c.HasCriticalVulnerabilities(ctx, registry, image)
+		if err != nil {
+			return false, err
+		}
+		if critical {
+			return false, fmt.Errorf("%w: image '%s' contains %s vulnerabilities", ErrFailedCompliance, image, ecr.FindingSeverityCritical)
+		}
+	}
 	return true, nil
 }
 
 // BatchCheckRepositoryCompliance checks the compliance of a given set of ECR images.
 // False is returned if a single repository is not compliant.
-func (c *Container) BatchCheckRepositoryCompliance(ctx context.Context, images []string) (bool, error) {
+func (c *Container) BatchCheckRepositoryCompliance(ctx context.Context, registry webhook.Registry, images []string, checks config.Checks) (bool, error) {
 	var mu sync.Mutex
 	g, ctx := errgroup.WithContext(ctx)
 	compliances := make([]bool, len(images))
@@ -81,7 +92,7 @@ func (c *Container) BatchCheckRepositoryCompliance(ctx context.Context, images [
 	for i, image := range images {
 		i, image := i, image // shadow
 		g.Go(func() error {
-			compliant, err := c.CheckRepositoryCompliance(ctx, image)
+			compliant, err := c.CheckRepositoryCompliance(ctx, registry, image, checks)
 
 			mu.Lock()
 			compliances[i] = compliant
@@ -102,70 +113,109 @@ func (c *Container) BatchCheckRepositoryCompliance(ctx context.Context, images [
 }
 
 // HasCriticalVulnerabilities checks if a container image contains 'CRITICAL' vulnerabilities.
-// func (c *Container) HasCriticalVulnerabilities(ctx context.Context, image string) (bool, error) {
-// 	var (
-// 		repo, tagOrDigest = parts(image)
-// 		found             = false
-// 	)
-// 	input := &ecr.DescribeImageScanFindingsInput{
-// 		ImageId:        &ecr.ImageIdentifier{},
-// 		RepositoryName: aws.String(repo),
-// 	}
-
-// 	switch strings.Contains(tagOrDigest, digestID) {
-// 	case true:
-// 		input.ImageId.ImageDigest = aws.String(tagOrDigest[1:]) // omit ampersand
-// 	default:
-// 		input.ImageId.ImageTag = aws.String(tagOrDigest)
-// 	}
-// 	if err := input.Validate(); err != nil {
-// 		return true, err
-// 	}
-
-// 	pager := func(out *ecr.DescribeImageScanFindingsOutput, lastPage bool) bool {
-// 		for _, finding := range out.ImageScanFindings.Findings {
-// 			if aws.StringValue(finding.Severity) == ecr.FindingSeverityCritical {
-// 				found = true
-// 				return found // break out of paging if we've already found a critical vuln.
-// 			}
-// 		}
-// 		return lastPage
-// 	}
-
-// 	if err := c.ECR.DescribeImageScanFindingsPagesWithContext(ctx, input, pager); err != nil {
-// 		return true, err
-// 	}
-// 	return found, nil
-// }
-
-func (c *Container) UpdateImage(ctx context.Context, image string) (string, error) {
-	repo, _ := parts(image)
-	name := reconstruct(repo)
+func (c *Container) HasCriticalVulnerabilities(ctx context.Context, registry webhook.Registry, image string) (bool, error) {
+	var (
+		repo, tagOrDigest = parts(image)
+		found             = false
+	)
+	input := &ecr.DescribeImageScanFindingsInput{
+		ImageId:        &ecr.ImageIdentifier{},
+		RegistryId:     aws.String(registry.AccountID),
+		RepositoryName: aws.String(repo),
+	}
+
+	switch strings.Contains(tagOrDigest, digestID) {
+	case true:
+		input.ImageId.ImageDigest = aws.String(tagOrDigest[1:]) // omit ampersand
+	default:
+		input.ImageId.ImageTag = aws.String(tagOrDigest)
+	}
+	if err := input.Validate(); err != nil {
+		return true, err
+	}
+
+	pager := func(out *ecr.DescribeImageScanFindingsOutput, lastPage bool) bool {
+		for _, finding := range out.ImageScanFindings.Findings {
+			if aws.StringValue(finding.Severity) == ecr.FindingSeverityCritical {
+				found = true
+				return false // break out of paging if we've already found a critical vuln.
+			}
+		}
+		return !lastPage
+	}
+
+	if err := c.ECR.ECRFor(registry).DescribeImageScanFindingsPagesWithContext(ctx, input, pager); err != nil {
+		return true, err
+	}
+	return found, nil
+}
+
+// Resolution is the tag an image was resolved to, and where the tag was read from.
+type Resolution struct {
+	// Image is the resolved image.
+	Image string
+	Tag   string
+	// Parameter is the SSM parameter the tag was read from; empty when the tag source is none.
+	Parameter string
+	// Version is the version of the parameter the tag was read from.
+	Version int64
+	// Fallback, when set, is why the image is pulled from its source registry rather than its replica.
+	Fallback string
+}
+
+// UpdateImage resolves the tag of the image from the profile's tag source.
+func (c *Container) UpdateImage(ctx context.Context, registry webhook.Registry, image string, profile config.Profile) (_ Resolution, err error) {
+	repo, tag := parts(image)
+	ctx, span := tracing.Start(ctx, "tag resolution", tracing.Repository.String(repo), attribute.String("tag.source", string(profile.TagSource)))
+	defer tracing.End(span, &err)
+	if profile.TagSource == config.TagSourceNone {
+		return Resolution{Image: image, Tag: tag}, nil
+	}
+	name, err := reconstruct(profile, repo)
+	if err != nil {
+		return Resolution{}, fmt.Errorf("%w: %v", ErrNoTagParameter, err)
+	}
+	span.SetAttributes(tracing.Parameter.String(name))
 	input := &ssm.GetParameterInput{
 		Name: &name,
 	}
 	if err := input.Validate(); err != nil {
-		return "", err
+		return Resolution{}, fmt.Errorf("%w: %v", ErrNoTagParameter, err)
 	}
-	output, err := c.SSMClient.SSM.GetParameter(input)
+	output, readAt, err := c.SSMClient.GetParameter(ctx, registry, input)
 	if err != nil {
-		return "", err
+		return Resolution{}, err
+	}
+	tag = aws.StringValue(output.Parameter.Value)
+	if c.LastKnown != nil {
+		c.LastKnown.Record(lastKnownKey(registry, name), tag, readAt)
 	}
 
 	// return to repository:tag
-	return fmt.Sprintf("%s:%s", repo, *output.Parameter.Value), nil
-
+	return Resolution{
+		Image:     fmt.Sprintf("%s:%s", repo, tag),
+		Tag:       tag,
+		Parameter: name,
+		Version:   aws.Int64Value(output.Parameter.Version),
+	}, nil
 }
 
-func (c *Container) BatchUpdateImage(ctx context.Context, registry string, images []string) ([]string, error) {
+// BatchUpdateImage updates the tag of a given set of ECR images, pulling them from
+// the replica of their registry when there is one.
+func (c *Container) BatchUpdateImage(ctx context.Context, registry webhook.Registry, images []string, profile config.Profile) ([]Resolution, error) {
 	g, ctx := errgroup.WithContext(ctx)
-	updateImages := make([]string, len(images))
+	resolutions := make([]Resolution, len(images))
 	for i, image := range images {
-		_, image := i, image // shadow
+		i, image := i, image // shadow
 		g.Go(func() error {
-			updated, err := c.UpdateImage(ctx, image)
-			updateImages[i] = fmt.Sprintf("%s/%s", registry, updated)
-			return err
+			resolution, err := c.UpdateImage(ctx, registry, image, profile)
+			if err != nil {
+				return err
+			}
+			host, fallback := c.ReplicaHost(ctx, registry, resolution.Image)
+			resolution.Image, resolution.Fallback = fmt.Sprintf("%s/%s", host, resolution.Image), fallback
+			resolutions[i] = resolution
+			return nil
 		})
 
 	}
@@ -173,5 +223,5 @@ func (c *Container) BatchUpdateImage(ctx context.Context, registry string, image
 		return nil, err
 	}
 
-	return updateImages, nil
+	return resolutions, nil
 }
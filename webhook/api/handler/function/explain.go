@@ -0,0 +1,76 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package function
+
+import (
+	"fmt"
+	"k8s-update-deployment-ecr-tag/webhook/api/config"
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/webhook"
+	"strconv"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+)
+
+// explain reports the resolution of the image of each container in the result's
+// warnings, displayed by kubectl, and in its audit annotations, recorded in the API
+// server's audit log, along with the compliance checks the image passed.
+func explain(result *Result, deployment *appsv1.Deployment, image string, resolution Resolution, profile config.Profile) {
+	_, previous := parts(image)
+	replaced := "replaced"
+	if profile.Mode == config.ModeAudit {
+		replaced = "would replace"
+	}
+	source := "kept by the tag source none"
+	if resolution.Parameter != "" {
+		source = "from " + resolution.Parameter
+		if resolution.Version != 0 {
+			source += fmt.Sprintf(" (version %d)", resolution.Version)
+		}
+	}
+	for _, c := range webhook.ContainerImages(deployment) {
+		if c.Image != image {
+			continue
+		}
+		switch {
+		case resolution.Image == image:
+			result.Warn("container %s: kept tag %s, %s", c.Name, previous, source)
+		case resolution.Tag == previous:
+			result.Warn("container %s: kept tag %s and pulled from %s, %s", c.Name, previous, resolution.Image, source)
+		default:
+			result.Warn("container %s: %s tag %s with %s, %s", c.Name, replaced, previous, resolution.Tag, source)
+		}
+	}
+
+	result.Annotate("image", resolution.Image)
+	result.Annotate("tag-source", string(profile.TagSource))
+	if resolution.Parameter != "" {
+		result.Annotate("parameter", resolution.Parameter)
+		result.Annotate("parameter-version", strconv.FormatInt(resolution.Version, 10))
+	}
+	result.Annotate("checks", checkResults(profile.Checks))
+	if profile.Environment != "" {
+		result.Annotate("environment", profile.Environment)
+	}
+	if profile.TagPolicy != "" {
+		result.Annotate("tag-policy", profile.TagPolicy)
+	}
+}
+
+// checkResults lists the compliance checks an image passed; the checks
+// not enforced by the profile are skipped.
+func checkResults(checks config.Checks) string {
+	result := func(enforced bool) string {
+		if enforced {
+			return "passed"
+		}
+		return "skipped"
+	}
+	return strings.Join([]string{
+		"repositoryExists=passed",
+		"tagImmutability=" + result(checks.TagImmutability),
+		"scanOnPush=" + result(checks.ScanOnPush),
+		"criticalVulnerabilities=" + result(checks.CriticalVulnerabilities),
+	}, ",")
+}
@@ -0,0 +1,115 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package function
+
+import (
+	"context"
+	"errors"
+	"k8s-update-deployment-ecr-tag/webhook/api/config"
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/webhook"
+	"k8s-update-deployment-ecr-tag/webhook/api/metrics"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+)
+
+// Errors returned when the repository or the tag parameter of an image is missing.
+var (
+	ErrRepositoryNotFound = errors.New("webhook: repository not found")
+	ErrNoTagParameter     = errors.New("webhook: repository has no tag parameter")
+)
+
+// Classify returns the error class of an admission failure. AWS requests rejected with
+// a client error, other than throttling or expired credentials, are misconfigurations;
+// other errors that are neither a missing resource nor a failed check are taken for AWS
+// being unavailable.
+func Classify(err error) config.ErrorClass {
+	var aerr awserr.Error
+	switch {
+	case errors.Is(err, ErrFailedCompliance), errors.Is(err, ErrConfigPathForbidden):
+		return config.ErrorPolicyViolation
+	case errors.Is(err, ErrRepositoryNotFound):
+		return config.ErrorRepositoryNotFound
+	case errors.Is(err, ErrNoTagParameter):
+		return config.ErrorParameterMissing
+	case errors.As(err, &aerr):
+		switch aerr.Code() {
+		case ecr.ErrCodeRepositoryNotFoundException:
+			return config.ErrorRepositoryNotFound
+		case ssm.ErrCodeParameterNotFound, ssm.ErrCodeParameterVersionNotFound:
+			return config.ErrorParameterMissing
+		case request.InvalidParameterErrCode:
+			return config.ErrorMisconfiguration
+		}
+		var failure awserr.RequestFailure
+		if errors.As(err, &failure) && failure.StatusCode() >= 400 && failure.StatusCode() < 500 &&
+			!request.IsErrorThrottle(err) && !request.IsErrorRetryable(err) && !request.IsErrorExpiredCreds(err) {
+			return config.ErrorMisconfiguration
+		}
+	}
+	return config.ErrorAWSUnavailable
+}
+
+// codeFor returns the HTTP status code of an admission denied for the error class.
+func codeFor(class config.ErrorClass) int32 {
+	switch class {
+	case config.ErrorParameterMissing:
+		return parameterCode
+	case config.ErrorAWSUnavailable:
+		return http.StatusServiceUnavailable
+	}
+	return code
+}
+
+// mutation is what an admission patches on its deployment, which a failure
+// allowing the admission keeps.
+type mutation struct {
+	deployment *appsv1.Deployment
+	registry   webhook.Registry
+	// image is the ECR image of the deployment, without the registry host.
+	image string
+	patch []webhook.PatchOperation
+}
+
+// fail takes the action the profile chooses for the error class of the failure: denying the
+// admission, or allowing it unmodified or with the last known tag of its image, with a warning.
+func (c *Container) fail(ctx context.Context, response *webhook.Response, profile config.Profile, m mutation, failure error) (*v1.AdmissionReview, error) {
+	class := Classify(failure)
+	action := profile.Action(class)
+	response.Annotate("error-class", string(class))
+	response.Annotate("action", string(action))
+	switch action {
+	case config.ActionAllow:
+		warn(ctx, response, "%s: %v; allowing the deployment without updating its image", class, failure)
+		return response.PassValidation(m.patch...)
+	case config.ActionLastKnownTag:
+		if image, known, parameter, ok := c.lastKnownImage(m.registry, m.image, profile); ok {
+			warn(ctx, response, "%s: %v; allowing the deployment with the last known image %s, resolved %s ago",
+				class, failure, image, c.now().Sub(known.ResolvedAt).Round(time.Second))
+			if class == config.ErrorAWSUnavailable {
+				c.revalidate(m.registry, parameter)
+			}
+			metrics.ObserveTagResolution(string(config.ActionLastKnownTag))
+			patch := append(m.patch[:len(m.patch):len(m.patch)], webhook.ImagePatches(m.deployment, m.registry.Host+"/"+m.image, image)...)
+			return response.PassValidation(patch...)
+		}
+		warn(ctx, response, "%s: %v; no tag is known within the max staleness, allowing the deployment without updating its image", class, failure)
+		return response.PassValidation(m.patch...)
+	}
+	log.WithContext(ctx).Errorf("Denying the deployment on %s: %v", class, failure)
+	return response.FailValidation(codeFor(class), failure)
+}
+
+// warn logs the warning, with the trace of the context, and returns it to the client of the admission.
+func warn(ctx context.Context, response *webhook.Response, format string, args ...interface{}) {
+	response.Warn(format, args...)
+	log.WithContext(ctx).Warnf(format, args...)
+}
@@ -0,0 +1,117 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"k8s-update-deployment-ecr-tag/webhook/api/breaker"
+	"k8s-update-deployment-ecr-tag/webhook/api/config"
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/webhook"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want config.ErrorClass
+	}{
+		{"Throttling", awserr.New("ThrottlingException", "rate exceeded", nil), config.ErrorAWSUnavailable},
+		{"CircuitOpen", awserr.New(breaker.ErrCodeOpen, "ssm is unavailable", nil), config.ErrorAWSUnavailable},
+		{"Unknown", errors.New("connection reset"), config.ErrorAWSUnavailable},
+		{"RepositoryNotFound", awserr.New(ecr.ErrCodeRepositoryNotFoundException, "not found", nil), config.ErrorRepositoryNotFound},
+		{"NoRepositories", fmt.Errorf("%w: gmt-backend", ErrRepositoryNotFound), config.ErrorRepositoryNotFound},
+		{"ParameterNotFound", awserr.New(ssm.ErrCodeParameterNotFound, "not found", nil), config.ErrorParameterMissing},
+		{"NamingTemplate", fmt.Errorf("%w: repository does not follow the naming template", ErrNoTagParameter), config.ErrorParameterMissing},
+		{"Compliance", fmt.Errorf("%w: scan on push disabled", ErrFailedCompliance), config.ErrorPolicyViolation},
+		{"AccessDenied", awserr.NewRequestFailure(awserr.New("AccessDeniedException", "not authorized to perform ssm:GetParametersByPath", nil), http.StatusBadRequest, "5d1a9c2"), config.ErrorMisconfiguration},
+		{"ValidationException", awserr.NewRequestFailure(awserr.New("ValidationException", "parameter name must not contain //", nil), http.StatusBadRequest, "5d1a9c2"), config.ErrorMisconfiguration},
+		{"InvalidParameter", fmt.Errorf("reading the configuration: %w", awserr.New(request.InvalidParameterErrCode, "1 validation error(s) found", nil)), config.ErrorMisconfiguration},
+		{"ThrottledRequest", awserr.NewRequestFailure(awserr.New("ThrottlingException", "rate exceeded", nil), http.StatusBadRequest, "5d1a9c2"), config.ErrorAWSUnavailable},
+		{"ExpiredToken", awserr.NewRequestFailure(awserr.New("ExpiredTokenException", "token expired", nil), http.StatusBadRequest, "5d1a9c2"), config.ErrorAWSUnavailable},
+		{"ServerError", awserr.NewRequestFailure(awserr.New("InternalServerError", "unavailable", nil), http.StatusInternalServerError, "5d1a9c2"), config.ErrorAWSUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, Classify(tt.err))
+		})
+	}
+}
+
+func TestFailWithLastKnownTag(t *testing.T) {
+	const host = "123456789012.dkr.ecr.eu-west-3.amazonaws.com"
+	registry := webhook.Registry{Host: host, AccountID: "123456789012", Region: "eu-west-3"}
+	deployment := &appsv1.Deployment{}
+	deployment.Spec.Template.Spec.Containers = []corev1.Container{{Name: "web", Image: host + "/gmt-backend:old"}}
+	m := mutation{deployment: deployment, registry: registry, image: "gmt-backend:old"}
+
+	policy := config.DefaultPolicy()
+	policy.OnFailure.AWSUnavailable = config.ActionLastKnownTag
+	profile := policy.Profile(nil)
+	outage := awserr.New("ThrottlingException", "rate exceeded", nil)
+
+	c := &Container{SSMClient: *NewSSMClient(&flakySSM{failures: revalidateAttempts}), LastKnown: NewLastKnownTags()}
+	response := &webhook.Response{Admission: &v1.AdmissionResponse{UID: "unknown"}}
+	review, err := c.fail(context.Background(), response, profile, m, outage)
+	require.NoError(t, err)
+	require.True(t, review.Response.Allowed)
+	require.Nil(t, review.Response.Patch, "no tag is known yet")
+	require.Len(t, review.Response.Warnings, 1)
+
+	c.LastKnown.Record(lastKnownKey(registry, "/gmt/backend/ecr_tag"), "5d1a9c2", time.Now())
+	response = &webhook.Response{Admission: &v1.AdmissionResponse{UID: "known"}}
+	review, err = c.fail(context.Background(), response, profile, m, outage)
+	require.NoError(t, err)
+	require.True(t, review.Response.Allowed)
+	require.JSONEq(t, `[{"op":"replace","path":"/spec/template/spec/containers/0/image","value":"`+host+`/gmt-backend:5d1a9c2"}]`, string(review.Response.Patch))
+
+	response = &webhook.Response{Admission: &v1.AdmissionResponse{UID: "violation"}}
+	review, err = c.fail(context.Background(), response, profile, m, ErrFailedCompliance)
+	require.NoError(t, err)
+	require.False(t, review.Response.Allowed, "policy violations are denied by default")
+
+	response = &webhook.Response{Admission: &v1.AdmissionResponse{UID: "misconfiguration"}}
+	denied := awserr.NewRequestFailure(awserr.New("AccessDeniedException", "not authorized to perform ssm:GetParameter", nil), http.StatusBadRequest, "5d1a9c2")
+	review, err = c.fail(context.Background(), response, profile, m, denied)
+	require.NoError(t, err)
+	require.False(t, review.Response.Allowed, "misconfigurations are denied rather than taken for AWS being unavailable")
+	require.Equal(t, string(config.ErrorMisconfiguration), review.Response.AuditAnnotations["error-class"])
+}
+
+func TestDenialReason(t *testing.T) {
+	failed := func(code int32, err error) *webhook.Response {
+		response := &webhook.Response{Admission: &v1.AdmissionResponse{UID: "denied"}}
+		response.FailValidation(code, err)
+		return response
+	}
+	classified := failed(parameterCode, awserr.New(ssm.ErrCodeParameterNotFound, "not found", nil))
+	classified.Annotate("error-class", string(config.ErrorParameterMissing))
+
+	tests := []struct {
+		name     string
+		response *webhook.Response
+		want     string
+	}{
+		{"BadRequest", nil, "badRequest"},
+		{"ErrorClass", classified, "parameterMissing"},
+		{"NoImages", failed(code, ErrImagesNotFound), "imagesNotFound"},
+		{"Panic", failed(http.StatusInternalServerError, errors.New("webhook: internal error: boom")), "internalError"},
+		{"UnexpectedResource", failed(code, webhook.ErrUnexpectedResource), "invalidDeployment"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, denialReason(tt.response))
+		})
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"k8s-update-deployment-ecr-tag/webhook/api/config"
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/webhook"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	log "github.com/sirupsen/logrus"
+)
+
+// lastKnownImage returns the image with the tag last resolved for its parameter,
+// along with that tag and the parameter.
+func (c *Container) lastKnownImage(registry webhook.Registry, image string, profile config.Profile) (string, KnownTag, string, bool) {
+	if c.LastKnown == nil {
+		return "", KnownTag{}, "", false
+	}
+	repo, _ := parts(image)
+	name, err := reconstruct(profile, repo)
+	if err != nil {
+		return "", KnownTag{}, "", false
+	}
+	known, ok := c.LastKnown.Get(lastKnownKey(registry, name))
+	if !ok {
+		return "", KnownTag{}, "", false
+	}
+	return fmt.Sprintf("%s/%s:%s", registry.Host, repo, known.Tag), known, name, true
+}
+
+// lastKnownKey identifies the tag parameter of images from the registry.
+func lastKnownKey(registry webhook.Registry, parameter string) string {
+	return registry.Host + parameter
+}
+
+// KnownTag is a tag resolved from its parameter.
+type KnownTag struct {
+	Tag        string    `json:"tag"`
+	ResolvedAt time.Time `json:"resolvedAt"`
+}
+
+// LastKnownTags remembers the tag last resolved for each parameter, in memory,
+// and serves it until it is older than the max staleness.
+type LastKnownTags struct {
+	// MaxStaleness, when positive, is the age beyond which a tag is no longer served.
+	MaxStaleness time.Duration
+	// now returns the current time; e.g. time.Now.
+	now func() time.Time
+
+	mu    sync.RWMutex
+	tags  map[string]KnownTag
+	dirty bool
+}
+
+// NewLastKnownTags creates an empty LastKnownTags.
+func NewLastKnownTags() *LastKnownTags {
+	return &LastKnownTags{tags: make(map[string]KnownTag), now: time.Now}
+}
+
+// Record remembers the tag resolved for the parameter, read from SSM at the time;
+// e.g. a while ago when it was cached. A more recently read tag is kept.
+func (l *LastKnownTags) Record(key, tag string, readAt time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if current, ok := l.tags[key]; ok && current.ResolvedAt.After(readAt) {
+		return
+	}
+	l.tags[key] = KnownTag{Tag: tag, ResolvedAt: readAt}
+	l.dirty = true
+}
+
+// Get returns the tag last resolved for the parameter, unless it is older than the max staleness.
+func (l *LastKnownTags) Get(key string) (KnownTag, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	known, ok := l.tags[key]
+	if !ok || (l.MaxStaleness > 0 && l.now().Sub(known.ResolvedAt) > l.MaxStaleness) {
+		return KnownTag{}, false
+	}
+	return known, true
+}
+
+// Restore remembers the tags of a snapshot, unless more recent ones were resolved since.
+func (l *LastKnownTags) Restore(tags map[string]KnownTag) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, known := range tags {
+		if current, ok := l.tags[key]; !ok || current.ResolvedAt.Before(known.ResolvedAt) {
+			l.tags[key] = known
+		}
+	}
+}
+
+// snapshot returns a copy of the tags when they changed since the last snapshot.
+func (l *LastKnownTags) snapshot() (map[string]KnownTag, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.dirty {
+		return nil, false
+	}
+	l.dirty = false
+	tags := make(map[string]KnownTag, len(l.tags))
+	for key, known := range l.tags {
+		tags[key] = known
+	}
+	return tags, true
+}
+
+// Persist saves the tags to the store on every interval they changed, until the context is done.
+func (l *LastKnownTags) Persist(ctx context.Context, store TagSnapshot, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			tags, changed := l.snapshot()
+			if !changed {
+				continue
+			}
+			if err := store.Save(ctx, tags); err != nil {
+				log.Warnf("Error saving the last known tags: %v", err)
+				l.mu.Lock()
+				l.dirty = true
+				l.mu.Unlock()
+			}
+		}
+	}
+}
+
+// TagSnapshot persists the last known tags, for them to survive restarts.
+type TagSnapshot interface {
+	Load(ctx context.Context) (map[string]KnownTag, error)
+	Save(ctx context.Context, tags map[string]KnownTag) error
+}
+
+// FileSnapshot persists the last known tags to a JSON file; e.g. on a persistent volume.
+type FileSnapshot struct {
+	Path string
+}
+
+// Load reads the tags of the file, none when it does not exist yet.
+func (f *FileSnapshot) Load(context.Context) (map[string]KnownTag, error) {
+	content, err := os.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tags map[string]KnownTag
+	if err := json.Unmarshal(content, &tags); err != nil {
+		return nil, fmt.Errorf("function: parsing last known tags %s: %w", f.Path, err)
+	}
+	return tags, nil
+}
+
+// Save replaces the file with the tags, atomically.
+func (f *FileSnapshot) Save(_ context.Context, tags map[string]KnownTag) error {
+	content, err := json.Marshal(tags)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.Path), filepath.Base(f.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.Path)
+}
+
+// Revalidation of the last known tags served while AWS is unavailable.
+const (
+	revalidateAttempts = 5
+	revalidateBackoff  = time.Second
+	revalidateTimeout  = 5 * time.Second
+)
+
+// revalidate reads the parameter in the background until AWS answers, retrying with
+// an exponential backoff, so that the next admissions get its current tag. A parameter
+// is only revalidated once at a time.
+func (c *Container) revalidate(registry webhook.Registry, parameter string) {
+	key := lastKnownKey(registry, parameter)
+	if _, revalidating := c.revalidating.LoadOrStore(key, true); revalidating {
+		return
+	}
+	go func() {
+		defer c.revalidating.Delete(key)
+		backoff := revalidateBackoff
+		for attempt := 1; attempt <= revalidateAttempts; attempt++ {
+			ctx, cancel := context.WithTimeout(context.Background(), revalidateTimeout)
+			output, readAt, err := c.SSMClient.GetParameter(ctx, registry, &ssm.GetParameterInput{Name: aws.String(parameter)})
+			cancel()
+			if err == nil {
+				c.LastKnown.Record(key, aws.StringValue(output.Parameter.Value), readAt)
+				log.Infof("Revalidated the last known tag of [%s]", parameter)
+				return
+			}
+			log.Debugf("Error revalidating [%s], attempt %d: %v", parameter, attempt, err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		log.Warnf("Giving up revalidating [%s] after %d attempts", parameter, revalidateAttempts)
+	}()
+}
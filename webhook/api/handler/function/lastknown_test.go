@@ -0,0 +1,113 @@
+package function
+
+import (
+	"context"
+	"k8s-update-deployment-ecr-tag/webhook/api/cache"
+	"k8s-update-deployment-ecr-tag/webhook/api/config"
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/webhook"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLastKnownTagsMaxStaleness(t *testing.T) {
+	now := time.Date(2020, 3, 7, 5, 30, 0, 0, time.UTC)
+	tags := NewLastKnownTags()
+	tags.now = func() time.Time { return now }
+	tags.MaxStaleness = time.Hour
+
+	tags.Record("/gmt/backend/ecr_tag", "5d1a9c2", now)
+	now = now.Add(time.Hour)
+	known, ok := tags.Get("/gmt/backend/ecr_tag")
+	require.True(t, ok)
+	require.Equal(t, "5d1a9c2", known.Tag)
+	now = now.Add(time.Second)
+	_, ok = tags.Get("/gmt/backend/ecr_tag")
+	require.False(t, ok, "the tag is older than the max staleness")
+
+	// A snapshot never replaces a more recent tag.
+	tags.Restore(map[string]KnownTag{
+		"/gmt/backend/ecr_tag":  {Tag: "bec0e8f", ResolvedAt: now.Add(-2 * time.Hour)},
+		"/gmt/frontend/ecr_tag": {Tag: "bec0e8f", ResolvedAt: now},
+	})
+	tags.Record("/gmt/backend/ecr_tag", "6e2b0d3", now)
+	known, _ = tags.Get("/gmt/backend/ecr_tag")
+	require.Equal(t, "6e2b0d3", known.Tag)
+	known, _ = tags.Get("/gmt/frontend/ecr_tag")
+	require.Equal(t, "bec0e8f", known.Tag)
+}
+
+func TestFileSnapshot(t *testing.T) {
+	snapshot := &FileSnapshot{Path: filepath.Join(t.TempDir(), "last-known-tags.json")}
+	tags, err := snapshot.Load(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, tags, "no snapshot was saved yet")
+
+	resolvedAt := time.Date(2020, 3, 7, 5, 30, 0, 0, time.UTC)
+	saved := map[string]KnownTag{"/gmt/backend/ecr_tag": {Tag: "5d1a9c2", ResolvedAt: resolvedAt}}
+	require.NoError(t, snapshot.Save(context.Background(), saved))
+	tags, err = snapshot.Load(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, saved, tags)
+}
+
+// flakySSM fails to read parameters its first failures calls.
+type flakySSM struct {
+	ssmiface.SSMAPI
+	failures int32
+	calls    int32
+}
+
+func (f *flakySSM) GetParameterWithContext(_ aws.Context, input *ssm.GetParameterInput, _ ...request.Option) (*ssm.GetParameterOutput, error) {
+	if atomic.AddInt32(&f.calls, 1) <= f.failures {
+		return nil, context.DeadlineExceeded
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssm.Parameter{Name: input.Name, Value: aws.String("6e2b0d3")}}, nil
+}
+
+func TestRevalidate(t *testing.T) {
+	registry := webhook.Registry{Host: "123456789012.dkr.ecr.eu-west-3.amazonaws.com"}
+	key := lastKnownKey(registry, "/gmt/backend/ecr_tag")
+	svc := &flakySSM{failures: 1}
+	c := &Container{SSMClient: *NewSSMClient(svc), LastKnown: NewLastKnownTags()}
+	c.LastKnown.Record(key, "5d1a9c2", time.Now())
+
+	// A parameter being revalidated is not revalidated again.
+	c.revalidate(registry, "/gmt/backend/ecr_tag")
+	c.revalidate(registry, "/gmt/backend/ecr_tag")
+	require.Eventually(t, func() bool {
+		_, revalidating := c.revalidating.Load(key)
+		return !revalidating
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, int32(2), atomic.LoadInt32(&svc.calls), "a single revalidation retried once")
+	known, _ := c.LastKnown.Get(key)
+	require.Equal(t, "6e2b0d3", known.Tag)
+}
+
+func TestLastKnownTagOfCachedParameter(t *testing.T) {
+	registry := webhook.Registry{Host: "123456789012.dkr.ecr.eu-west-3.amazonaws.com"}
+	key := lastKnownKey(registry, "/gmt/backend/ecr_tag")
+	svc := &flakySSM{}
+	c := &Container{SSMClient: *NewSSMClient(svc), LastKnown: NewLastKnownTags()}
+	c.SSMClient.Cache = cache.New(ssmCache, time.Minute, 0, 0, nil)
+	policy := config.DefaultPolicy()
+	profile := policy.Profile(nil)
+
+	_, err := c.UpdateImage(context.Background(), registry, "gmt-backend:latest", profile)
+	require.NoError(t, err)
+	read, _ := c.LastKnown.Get(key)
+	time.Sleep(10 * time.Millisecond)
+	resolution, err := c.UpdateImage(context.Background(), registry, "gmt-backend:latest", profile)
+	require.NoError(t, err)
+	require.Equal(t, "6e2b0d3", resolution.Tag)
+	require.Equal(t, int32(1), atomic.LoadInt32(&svc.calls), "the parameter is cached")
+	known, _ := c.LastKnown.Get(key)
+	require.Equal(t, read.ResolvedAt, known.ResolvedAt, "the tag is as old as when it was read from SSM")
+}
@@ -18,11 +18,25 @@ type Handler func(context.Context, *http.Request) (*v1.AdmissionReview, error)
 // ProxiedHandler is a handler that has been wrapped to respond with an API Gateway Proxy Integration.
 // type ProxiedHandler func(ctx context.Context, event events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)
 
-// WithLogging is a logging middleware for the Lambda handler.
+// WithLogging is a logging middleware for the Lambda handler, logging the response of each
+// review. The handler of the Container logs the decisions of deployment admissions itself.
 func (h Handler) WithLogging() Handler {
 	return func(ctx context.Context, event *http.Request) (*v1.AdmissionReview, error) {
 		review, err := h(ctx, event)
-		log.Infof("Responding with AdmissionReview [%+v] and error [%v]", review, err)
+		if err != nil {
+			log.WithContext(ctx).Errorf("Error reviewing the admission: %v", err)
+			return review, err
+		}
+		fields := log.Fields{}
+		if review != nil && review.Response != nil {
+			fields["uid"] = review.Response.UID
+			fields["allowed"] = review.Response.Allowed
+			if result := review.Response.Result; result != nil {
+				fields["code"] = result.Code
+				fields["message"] = result.Message
+			}
+		}
+		log.WithContext(ctx).WithFields(fields).Info("Admission reviewed")
 		return review, err
 	}
 }
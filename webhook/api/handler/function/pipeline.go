@@ -0,0 +1,154 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package function
+
+import (
+	"context"
+	"fmt"
+	"k8s-update-deployment-ecr-tag/webhook/api/config"
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/webhook"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Plugin is a step of the admission pipeline. Mutators return patch operations,
+// validators deny the admission with an error, and both can warn the client.
+type Plugin interface {
+	// Name identifies the plugin in the logs.
+	Name() string
+	Admit(ctx context.Context, admission *Admission) Result
+}
+
+// Admission is the deployment going through the pipeline, along with what
+// the plugins before resolved for the plugins after.
+type Admission struct {
+	Deployment *appsv1.Deployment
+	Profile    config.Profile
+	Registry   webhook.Registry
+	// Image is the ECR image of the deployment, without the registry host.
+	Image string
+	// Resolution is the image resolved by the TagUpdate plugin, nil until it runs.
+	Resolution *Resolution
+
+	// env is the environment of the containers patched by the plugins, by the path of their env list.
+	env map[string][]corev1.EnvVar
+}
+
+// EnvPatches returns the patch operations setting the environment variables in every container
+// of the image, on top of those the plugins before set, so that plugins never undo each other.
+func (a *Admission) EnvPatches(env ...corev1.EnvVar) []webhook.PatchOperation {
+	if a.env == nil {
+		a.env = make(map[string][]corev1.EnvVar)
+	}
+	var patch []webhook.PatchOperation
+	for _, c := range webhook.ContainerImages(a.Deployment) {
+		if c.Image != a.Reference() {
+			continue
+		}
+		path := strings.TrimSuffix(c.Path, "/image") + "/env"
+		current, ok := a.env[path]
+		if !ok {
+			current = c.Env
+		}
+		patch = append(patch, webhook.EnvPatches(path, current, env...)...)
+		a.env[path] = mergeEnv(current, env)
+	}
+	return patch
+}
+
+// mergeEnv returns the environment variables with env set, as patched by EnvPatches.
+func mergeEnv(current, env []corev1.EnvVar) []corev1.EnvVar {
+	merged := append([]corev1.EnvVar(nil), current...)
+	for _, e := range env {
+		replaced := false
+		for i := range merged {
+			if merged[i].Name == e.Name {
+				merged[i], replaced = e, true
+				break
+			}
+		}
+		if !replaced {
+			merged = append(merged, e)
+		}
+	}
+	return merged
+}
+
+// Reference returns the image of the deployment with its registry host.
+func (a *Admission) Reference() string {
+	return a.Registry.Host + "/" + a.Image
+}
+
+// Result is the outcome of a plugin.
+type Result struct {
+	Patch []webhook.PatchOperation
+	// Warnings are displayed by kubectl, and Annotations recorded in the API server's audit log.
+	Warnings    []string
+	Annotations map[string]string
+	// Err denies the admission, unless the profile's action for its error class allows it.
+	Err error
+}
+
+// Warn adds a warning to the result.
+func (r *Result) Warn(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// Annotate adds an audit annotation to the result.
+func (r *Result) Annotate(key, value string) {
+	if r.Annotations == nil {
+		r.Annotations = make(map[string]string)
+	}
+	r.Annotations[key] = value
+}
+
+// Deny returns the result denying the admission with the error.
+func Deny(err error) Result {
+	return Result{Err: err}
+}
+
+// DefaultPlugins returns the plugins every admission goes through unless replaced: the compliance
+// checks, the tag update, the annotations and labels it is recorded in, then the configuration
+// the deployment asks for.
+func (c *Container) DefaultPlugins() []Plugin {
+	return []Plugin{
+		&ComplianceCheck{Container: c},
+		&TagUpdate{Container: c},
+		&Provenance{Container: c},
+		&VersionInjector{},
+		&ConfigInjector{Container: c},
+	}
+}
+
+// admit runs the admission through the plugins in order, merging their results into
+// the response once they all admitted it. The first plugin denying the admission ends
+// the pipeline, and its error takes the action the profile chooses for its class, on the
+// mutation as it was before the plugins: the patches, warnings and annotations of the
+// plugins that ran are dropped, lest they report a mutation that is not applied.
+func (c *Container) admit(ctx context.Context, response *webhook.Response, admission *Admission, m mutation) (*v1.AdmissionReview, error) {
+	merged := Result{Patch: m.patch[:len(m.patch):len(m.patch)]}
+	for _, plugin := range c.Plugins {
+		result := plugin.Admit(ctx, admission)
+		if result.Err != nil {
+			log.WithContext(ctx).Errorf("Plugin [%s] failed the deployment: %v", plugin.Name(), result.Err)
+			return c.fail(ctx, response, admission.Profile, m, result.Err)
+		}
+		merged.Patch = append(merged.Patch, result.Patch...)
+		merged.Warnings = append(merged.Warnings, result.Warnings...)
+		for key, value := range result.Annotations {
+			merged.Annotate(key, value)
+		}
+	}
+	for _, warning := range merged.Warnings {
+		response.Warn("%s", warning)
+	}
+	for key, value := range merged.Annotations {
+		response.Annotate(key, value)
+	}
+	return response.PassValidation(merged.Patch...)
+}
@@ -0,0 +1,102 @@
+package function
+
+import (
+	"context"
+	"k8s-update-deployment-ecr-tag/webhook/api/config"
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/webhook"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// pluginFunc adapts a function to a Plugin.
+type pluginFunc func(a *Admission) Result
+
+func (f pluginFunc) Name() string { return "test" }
+
+func (f pluginFunc) Admit(_ context.Context, a *Admission) Result { return f(a) }
+
+func TestAdmit(t *testing.T) {
+	label := pluginFunc(func(a *Admission) Result {
+		result := Result{Patch: webhook.MapPatches("/metadata/labels", nil, map[string]string{"team": "a"})}
+		result.Warn("labelled %s", a.Image)
+		result.Annotate("team", "a")
+		return result
+	})
+	deny := pluginFunc(func(*Admission) Result { return Deny(ErrFailedCompliance) })
+	unreachable := pluginFunc(func(*Admission) Result { panic("the pipeline should have ended") })
+
+	policy := config.DefaultPolicy()
+	admission := &Admission{Deployment: &appsv1.Deployment{}, Profile: policy.Profile(nil), Image: "gmt-backend:old"}
+	pullThrough := []webhook.PatchOperation{webhook.ReplaceImage("/spec/template/spec/containers/1/image", "cache/envoy")}
+
+	c := &Container{Plugins: []Plugin{label, label}}
+	response := &webhook.Response{Admission: &v1.AdmissionResponse{}}
+	review, err := c.admit(context.Background(), response, admission, mutation{patch: pullThrough})
+	require.NoError(t, err)
+	require.True(t, review.Response.Allowed)
+	require.Equal(t, []string{"labelled gmt-backend:old", "labelled gmt-backend:old"}, review.Response.Warnings)
+	require.Equal(t, map[string]string{"team": "a"}, review.Response.AuditAnnotations)
+	require.Len(t, response.Patch(), 3, "the patches of every plugin are merged after the pull-through ones")
+
+	c = &Container{Plugins: []Plugin{label, deny, unreachable}}
+	response = &webhook.Response{Admission: &v1.AdmissionResponse{}}
+	review, err = c.admit(context.Background(), response, admission, mutation{})
+	require.NoError(t, err)
+	require.False(t, review.Response.Allowed)
+	require.Empty(t, review.Response.Warnings, "the warnings of the plugins that ran are dropped")
+	require.NotContains(t, review.Response.AuditAnnotations, "team")
+	require.Equal(t, string(config.ErrorPolicyViolation), review.Response.AuditAnnotations["error-class"])
+}
+
+func TestAdmitFailingAfterTagUpdate(t *testing.T) {
+	const host = "123456789012.dkr.ecr.eu-west-3.amazonaws.com"
+	registry := webhook.Registry{Host: host, AccountID: "123456789012", Region: "eu-west-3"}
+	deployment := &appsv1.Deployment{}
+	deployment.Spec.Template.Spec.Containers = []corev1.Container{{Name: "web", Image: host + "/gmt-backend:old"}, {Name: "envoy", Image: "envoy"}}
+	pullThrough := webhook.ReplaceImage("/spec/template/spec/containers/1/image", "cache/envoy")
+	tagUpdate := pluginFunc(func(*Admission) Result {
+		result := Result{Patch: []webhook.PatchOperation{webhook.ReplaceImage("/spec/template/spec/containers/0/image", host+"/gmt-backend:bec0e8f")}}
+		result.Warn("replaced tag old of gmt-backend with bec0e8f")
+		result.Annotate("image", host+"/gmt-backend:bec0e8f")
+		return result
+	})
+	outage := pluginFunc(func(*Admission) Result { return Deny(awserr.New("ThrottlingException", "rate exceeded", nil)) })
+
+	tests := []struct {
+		name   string
+		action config.FailAction
+		patch  string
+	}{
+		{"Allow", config.ActionAllow, `[{"op":"replace","path":"/spec/template/spec/containers/1/image","value":"cache/envoy"}]`},
+		{"LastKnownTag", config.ActionLastKnownTag, `[
+			{"op":"replace","path":"/spec/template/spec/containers/1/image","value":"cache/envoy"},
+			{"op":"replace","path":"/spec/template/spec/containers/0/image","value":"` + host + `/gmt-backend:5d1a9c2"}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := config.DefaultPolicy()
+			policy.OnFailure.AWSUnavailable = tt.action
+			admission := &Admission{Deployment: deployment, Profile: policy.Profile(nil), Registry: registry, Image: "gmt-backend:old"}
+			c := &Container{Plugins: []Plugin{tagUpdate, outage}, SSMClient: *NewSSMClient(&flakySSM{failures: revalidateAttempts}), LastKnown: NewLastKnownTags()}
+			c.LastKnown.Record(lastKnownKey(registry, "/gmt/backend/ecr_tag"), "5d1a9c2", time.Now())
+
+			m := mutation{deployment: deployment, registry: registry, image: "gmt-backend:old", patch: []webhook.PatchOperation{pullThrough}}
+			response := &webhook.Response{Admission: &v1.AdmissionResponse{UID: "705ab4f5"}}
+			review, err := c.admit(context.Background(), response, admission, m)
+			require.NoError(t, err)
+			require.True(t, review.Response.Allowed)
+			require.JSONEq(t, tt.patch, string(review.Response.Patch), "the patches of the plugins that ran are not applied")
+			require.Equal(t, []webhook.PatchOperation{pullThrough}, m.patch)
+			require.Len(t, review.Response.Warnings, 1, "only the failure is warned of")
+			require.NotContains(t, review.Response.Warnings[0], "replaced tag")
+			require.NotContains(t, review.Response.AuditAnnotations, "image", "the annotations of the plugins that ran are dropped")
+			require.Equal(t, string(config.ErrorAWSUnavailable), review.Response.AuditAnnotations["error-class"])
+		})
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package function
+
+import (
+	"context"
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/webhook"
+	"k8s-update-deployment-ecr-tag/webhook/api/metrics"
+)
+
+// ComplianceCheck denies the images whose repository fails the checks of the profile.
+type ComplianceCheck struct {
+	*Container
+}
+
+// Name identifies the plugin.
+func (p *ComplianceCheck) Name() string { return "compliance" }
+
+// Admit checks the repository of the image.
+func (p *ComplianceCheck) Admit(ctx context.Context, a *Admission) Result {
+	compliant, err := p.BatchCheckRepositoryCompliance(ctx, a.Registry, []string{a.Image}, a.Profile.Checks)
+	if err != nil {
+		return Deny(err)
+	}
+	if !compliant {
+		return Deny(ErrFailedCompliance)
+	}
+	return Result{}
+}
+
+// TagUpdate replaces the tag of the image with the one its tag source resolves.
+type TagUpdate struct {
+	*Container
+}
+
+// Name identifies the plugin.
+func (p *TagUpdate) Name() string { return "tagUpdate" }
+
+// Admit resolves the image and explains its resolution, warning when it is pulled
+// from its source registry for lack of a replica.
+func (p *TagUpdate) Admit(ctx context.Context, a *Admission) Result {
+	resolutions, err := p.BatchUpdateImage(ctx, a.Registry, []string{a.Image}, a.Profile)
+	if err != nil {
+		return Deny(err)
+	}
+	a.Resolution = &resolutions[0]
+	metrics.ObserveTagResolution(string(a.Profile.TagSource))
+
+	var result Result
+	explain(&result, a.Deployment, a.Reference(), *a.Resolution, a.Profile)
+	if a.Resolution.Fallback != "" {
+		result.Warn("%s", a.Resolution.Fallback)
+	}
+	result.Patch = webhook.ImagePatches(a.Deployment, a.Reference(), a.Resolution.Image)
+	return result
+}
+
+// Provenance annotates the deployment with the provenance of the image resolved.
+type Provenance struct {
+	*Container
+}
+
+// Name identifies the plugin.
+func (p *Provenance) Name() string { return "provenance" }
+
+// Admit annotates the deployment once the image is resolved.
+func (p *Provenance) Admit(_ context.Context, a *Admission) Result {
+	if a.Resolution == nil {
+		return Result{}
+	}
+	return Result{Patch: p.provenancePatches(a.Deployment, a.Reference(), *a.Resolution, a.Profile)}
+}
+
+// VersionInjector injects the tag resolved into the deployment, as its profile asks.
+type VersionInjector struct{}
+
+// Name identifies the plugin.
+func (p *VersionInjector) Name() string { return "version" }
+
+// Admit injects the tag once the image is resolved.
+func (p *VersionInjector) Admit(_ context.Context, a *Admission) Result {
+	if a.Resolution == nil {
+		return Result{}
+	}
+	var result Result
+	result.Patch = versionPatches(&result, a)
+	return result
+}
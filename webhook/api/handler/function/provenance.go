@@ -0,0 +1,89 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package function
+
+import (
+	"fmt"
+	"k8s-update-deployment-ecr-tag/webhook/api/config"
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/webhook"
+	"strconv"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+)
+
+// Annotations recording the provenance of the image on mutated deployments and their pod template.
+const (
+	OriginalImageAnnotation    = "ecr-tag.brilliantsolutions.com/original-image"
+	ResolvedImageAnnotation    = "ecr-tag.brilliantsolutions.com/resolved-image"
+	TagSourceAnnotation        = "ecr-tag.brilliantsolutions.com/tag-source"
+	TagSourceKeyAnnotation     = "ecr-tag.brilliantsolutions.com/tag-source-key"
+	ParameterVersionAnnotation = "ecr-tag.brilliantsolutions.com/parameter-version"
+	ResolvedAtAnnotation       = "ecr-tag.brilliantsolutions.com/resolved-at"
+	// ChangeCauseAnnotation is shown by `kubectl rollout history` for each revision.
+	ChangeCauseAnnotation = "kubernetes.io/change-cause"
+)
+
+// provenancePatches returns the patch operations annotating the deployment and its pod template
+// with the provenance of the image resolved. The resolution time is only updated along with
+// the resolved image, so that admitting the same image again does not roll the pods out.
+func (c *Container) provenancePatches(deployment *appsv1.Deployment, image string, resolution Resolution, profile config.Profile) []webhook.PatchOperation {
+	provenance := map[string]string{
+		OriginalImageAnnotation: image,
+		ResolvedImageAnnotation: resolution.Image,
+		TagSourceAnnotation:     string(profile.TagSource),
+	}
+	if resolution.Parameter != "" {
+		provenance[TagSourceKeyAnnotation] = resolution.Parameter
+	}
+	if resolution.Version != 0 {
+		provenance[ParameterVersionAnnotation] = strconv.FormatInt(resolution.Version, 10)
+	}
+	now := c.now().UTC().Format(time.RFC3339)
+
+	workload := copyAnnotations(provenance)
+	workload[ChangeCauseAnnotation] = changeCause(resolution)
+	template := copyAnnotations(provenance)
+	if newlyResolved(deployment.Annotations, resolution) {
+		workload[ResolvedAtAnnotation] = now
+	}
+	if newlyResolved(deployment.Spec.Template.Annotations, resolution) {
+		template[ResolvedAtAnnotation] = now
+	}
+
+	patch := webhook.MapPatches("/metadata/annotations", deployment.Annotations, workload)
+	return append(patch, webhook.MapPatches("/spec/template/metadata/annotations", deployment.Spec.Template.Annotations, template)...)
+}
+
+// newlyResolved checks that the annotations do not already date the resolution of the image.
+func newlyResolved(annotations map[string]string, resolution Resolution) bool {
+	return annotations[ResolvedImageAnnotation] != resolution.Image || annotations[ResolvedAtAnnotation] == ""
+}
+
+// changeCause describes the resolution for the rollout history.
+func changeCause(resolution Resolution) string {
+	switch {
+	case resolution.Parameter == "":
+		return fmt.Sprintf("ecr-tag: kept image %s", resolution.Image)
+	case resolution.Version == 0:
+		return fmt.Sprintf("ecr-tag: set image %s from %s", resolution.Image, resolution.Parameter)
+	}
+	return fmt.Sprintf("ecr-tag: set image %s from %s (version %d)", resolution.Image, resolution.Parameter, resolution.Version)
+}
+
+func copyAnnotations(annotations map[string]string) map[string]string {
+	copied := make(map[string]string, len(annotations)+2)
+	for k, v := range annotations {
+		copied[k] = v
+	}
+	return copied
+}
+
+// now returns the current time from the container's clock.
+func (c *Container) now() time.Time {
+	if c.Clock != nil {
+		return c.Clock()
+	}
+	return time.Now()
+}
@@ -0,0 +1,88 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package function
+
+import (
+	"errors"
+	"fmt"
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/webhook"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+)
+
+// ErrPublicImages is returned when containers would pull directly from a public registry.
+var ErrPublicImages = errors.New("webhook: images must be pulled through an ecr pull-through cache")
+
+// PullThroughCache rewrites images from upstream registries to the
+// ECR pull-through cache repositories that mirror them.
+type PullThroughCache struct {
+	// Prefixes maps an upstream registry host to the pull-through cache prefix serving it;
+	// e.g. docker.io to aws_account_id.dkr.ecr.aws_region.amazonaws.com/docker-hub.
+	Prefixes map[string]string
+	// Enforce denies the deployment when a container would still pull from outside ECR.
+	Enforce bool
+}
+
+// Rewrite returns the image pulled through the cache of its upstream registry, if it has one.
+func (p *PullThroughCache) Rewrite(image string) (string, bool) {
+	host, path := webhook.NormalizeImage(image)
+	prefix, ok := p.Prefixes[host]
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprintf("%s/%s", strings.TrimSuffix(prefix, "/"), path), true
+}
+
+// Cached checks if the image is served from one of the pull-through caches.
+func (p *PullThroughCache) Cached(image string) bool {
+	if p == nil {
+		return false
+	}
+	for _, prefix := range p.Prefixes {
+		if strings.HasPrefix(image, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// PullThroughPatches returns the patch operations rewriting the non ECR images
+// of the deployment to their pull-through cache repository.
+func (c *Container) PullThroughPatches(deployment *appsv1.Deployment) ([]webhook.PatchOperation, error) {
+	if c.PullThrough == nil {
+		return nil, nil
+	}
+	var (
+		patch  []webhook.PatchOperation
+		direct []string
+	)
+	for _, container := range webhook.ContainerImages(deployment) {
+		if webhook.ECRImageRegex.MatchString(container.Image) {
+			continue
+		}
+		cached, ok := c.PullThrough.Rewrite(container.Image)
+		if !ok {
+			direct = append(direct, container.Image)
+			continue
+		}
+		patch = append(patch, webhook.ReplaceImage(container.Path, cached))
+	}
+	if c.PullThrough.Enforce && len(direct) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrPublicImages, strings.Join(direct, ", "))
+	}
+	return patch, nil
+}
+
+// taggedImages filters out the images served from a pull-through cache,
+// whose tag is not managed through parameters.
+func (c *Container) taggedImages(registry string, images []string) []string {
+	var tagged []string
+	for _, image := range images {
+		if !c.PullThrough.Cached(fmt.Sprintf("%s/%s", registry, image)) {
+			tagged = append(tagged, image)
+		}
+	}
+	return tagged
+}
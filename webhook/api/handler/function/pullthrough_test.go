@@ -0,0 +1,101 @@
+package function
+
+import (
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/webhook"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const cachePrefix = "123456789012.dkr.ecr.eu-west-3.amazonaws.com/docker-hub"
+
+func TestPullThroughCacheRewrite(t *testing.T) {
+	p := &PullThroughCache{Prefixes: map[string]string{"docker.io": cachePrefix + "/", "quay.io": "123456789012.dkr.ecr.eu-west-3.amazonaws.com/quay"}}
+	tests := []struct {
+		name  string
+		image string
+		want  string
+	}{
+		{"ShortName", "nginx:1.19", cachePrefix + "/library/nginx:1.19"},
+		{"Organization", "bitnami/redis:6.0", cachePrefix + "/bitnami/redis:6.0"},
+		{"DockerHubAlias", "index.docker.io/library/nginx", cachePrefix + "/library/nginx"},
+		{"Quay", "quay.io/coreos/etcd:v3.4", "123456789012.dkr.ecr.eu-west-3.amazonaws.com/quay/coreos/etcd:v3.4"},
+		{"NoCache", "ghcr.io/org/app:1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := p.Rewrite(tt.image)
+			require.Equal(t, tt.want != "", ok)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestPullThroughCacheCached(t *testing.T) {
+	p := &PullThroughCache{Prefixes: map[string]string{"docker.io": cachePrefix + "/"}}
+	tests := []struct {
+		name  string
+		cache *PullThroughCache
+		image string
+		want  bool
+	}{
+		{"Cached", p, cachePrefix + "/library/nginx:1.19", true},
+		{"SharedPrefix", p, cachePrefix + "-mirror/library/nginx:1.19", false},
+		{"Tagged", p, "123456789012.dkr.ecr.eu-west-3.amazonaws.com/gmt-backend:5d1a9c2", false},
+		{"NoCache", nil, cachePrefix + "/library/nginx:1.19", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, tt.cache.Cached(tt.image))
+		})
+	}
+}
+
+func TestPullThroughPatches(t *testing.T) {
+	deployment := func(images ...string) *appsv1.Deployment {
+		d := &appsv1.Deployment{}
+		for _, image := range images {
+			d.Spec.Template.Spec.Containers = append(d.Spec.Template.Spec.Containers, corev1.Container{Image: image})
+		}
+		d.Spec.Template.Spec.InitContainers = []corev1.Container{{Image: "busybox"}}
+		return d
+	}
+	prefixes := map[string]string{"docker.io": cachePrefix}
+
+	tests := []struct {
+		name       string
+		cache      *PullThroughCache
+		deployment *appsv1.Deployment
+		want       []webhook.PatchOperation
+		wantErr    bool
+	}{
+		{"NoCache", nil, deployment("nginx:1.19"), nil, false},
+		{"Rewritten", &PullThroughCache{Prefixes: prefixes}, deployment("123456789012.dkr.ecr.eu-west-3.amazonaws.com/gmt-backend:old", "nginx:1.19"), []webhook.PatchOperation{
+			webhook.ReplaceImage("/spec/template/spec/containers/1/image", cachePrefix+"/library/nginx:1.19"),
+			webhook.ReplaceImage("/spec/template/spec/initContainers/0/image", cachePrefix+"/library/busybox"),
+		}, false},
+		{"UncachedKept", &PullThroughCache{Prefixes: prefixes}, deployment("ghcr.io/org/app:1"), []webhook.PatchOperation{
+			webhook.ReplaceImage("/spec/template/spec/initContainers/0/image", cachePrefix+"/library/busybox"),
+		}, false},
+		{"UncachedEnforced", &PullThroughCache{Prefixes: prefixes, Enforce: true}, deployment("ghcr.io/org/app:1"), nil, true},
+		{"CachedEnforced", &PullThroughCache{Prefixes: prefixes, Enforce: true}, deployment("nginx:1.19"), []webhook.PatchOperation{
+			webhook.ReplaceImage("/spec/template/spec/containers/0/image", cachePrefix+"/library/nginx:1.19"),
+			webhook.ReplaceImage("/spec/template/spec/initContainers/0/image", cachePrefix+"/library/busybox"),
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Container{PullThrough: tt.cache}
+			got, err := c.PullThroughPatches(tt.deployment)
+			if tt.wantErr {
+				require.ErrorIs(t, err, ErrPublicImages)
+				require.Contains(t, err.Error(), "ghcr.io/org/app:1")
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package function
+
+import (
+	"context"
+	"fmt"
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/webhook"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	log "github.com/sirupsen/logrus"
+)
+
+// Replication describes where the replicas of the registries referenced by images live.
+type Replication struct {
+	// Region is the cluster's region. The replica of a registry in another region
+	// is the registry of the same account in this region.
+	Region string
+	// Registries maps a source registry host to the host of its replica,
+	// and takes precedence over Region.
+	Registries map[string]string
+}
+
+// ReplicaFor returns the replica of the source registry, if it has one.
+func (r *Replication) ReplicaFor(source webhook.Registry) (webhook.Registry, bool) {
+	host, ok := r.Registries[source.Host]
+	if !ok {
+		if r.Region == "" || source.Region == "" || source.Region == r.Region {
+			return webhook.Registry{}, false
+		}
+		host = strings.Replace(source.Host, "."+source.Region+".", "."+r.Region+".", 1)
+	}
+	replica, err := webhook.ParseRegistry(host)
+	if err != nil {
+		log.Warnf("Ignoring replica [%s] of registry [%s]: %v", host, source.Host, err)
+		return webhook.Registry{}, false
+	}
+	return replica, true
+}
+
+// ReplicaHost returns the host of the registry to pull the image from. That is the
+// host of the source registry's replica once the image has replicated to it, and
+// the source registry's host otherwise, with the reason it falls back to it.
+func (c *Container) ReplicaHost(ctx context.Context, registry webhook.Registry, image string) (host, fallback string) {
+	if c.Replication == nil {
+		return registry.Host, ""
+	}
+	replica, ok := c.Replication.ReplicaFor(registry)
+	if !ok {
+		return registry.Host, ""
+	}
+	replicated, err := c.IsReplicated(ctx, replica, image)
+	if err != nil {
+		fallback = fmt.Sprintf("could not check that image %s replicated to %s, pulling it from %s: %v", image, replica.Host, registry.Host, err)
+	} else if !replicated {
+		fallback = fmt.Sprintf("image %s has not replicated to %s yet, pulling it from %s", image, replica.Host, registry.Host)
+	} else {
+		return replica.Host, ""
+	}
+	log.WithContext(ctx).Warn(fallback)
+	return registry.Host, fallback
+}
+
+// IsReplicated checks if the image exists in the replica registry.
+func (c *Container) IsReplicated(ctx context.Context, replica webhook.Registry, image string) (bool, error) {
+	repo, tagOrDigest := parts(image)
+	id := &ecr.ImageIdentifier{}
+	if strings.HasPrefix(tagOrDigest, digestID) {
+		id.ImageDigest = aws.String(tagOrDigest[1:]) // omit ampersand
+	} else {
+		id.ImageTag = aws.String(tagOrDigest)
+	}
+	input := &ecr.DescribeImagesInput{
+		RegistryId:     aws.String(replica.AccountID),
+		RepositoryName: aws.String(repo),
+		ImageIds:       []*ecr.ImageIdentifier{id},
+	}
+	if err := input.Validate(); err != nil {
+		return false, err
+	}
+	output, err := c.ECR.ECRFor(replica).DescribeImagesWithContext(ctx, input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == ecr.ErrCodeImageNotFoundException || aerr.Code() == ecr.ErrCodeRepositoryNotFoundException) {
+			return false, nil
+		}
+		return false, err
+	}
+	return len(output.ImageDetails) > 0, nil
+}
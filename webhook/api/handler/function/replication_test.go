@@ -0,0 +1,116 @@
+package function
+
+import (
+	"context"
+	"k8s-update-deployment-ecr-tag/webhook/api/config"
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/webhook"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// fakeReplicas serves the images of each registry host, failing with the error of a host when set.
+type fakeReplicas struct {
+	images map[string][]string
+	errs   map[string]error
+}
+
+func (f *fakeReplicas) ECRFor(registry webhook.Registry) ecriface.ECRAPI {
+	return &fakeReplica{fakeReplicas: f, host: registry.Host}
+}
+
+type fakeReplica struct {
+	ecriface.ECRAPI
+	*fakeReplicas
+	host string
+}
+
+func (f *fakeReplica) DescribeImagesWithContext(_ aws.Context, input *ecr.DescribeImagesInput, _ ...request.Option) (*ecr.DescribeImagesOutput, error) {
+	if err := f.errs[f.host]; err != nil {
+		return nil, err
+	}
+	image := aws.StringValue(input.RepositoryName) + ":" + aws.StringValue(input.ImageIds[0].ImageTag)
+	for _, i := range f.images[f.host] {
+		if i == image {
+			return &ecr.DescribeImagesOutput{ImageDetails: []*ecr.ImageDetail{{}}}, nil
+		}
+	}
+	return nil, awserr.New(ecr.ErrCodeImageNotFoundException, "image not found", nil)
+}
+
+const (
+	sourceHost  = "123456789012.dkr.ecr.eu-west-3.amazonaws.com"
+	replicaHost = "123456789012.dkr.ecr.us-east-1.amazonaws.com"
+)
+
+func TestReplicaFor(t *testing.T) {
+	source := webhook.Registry{Host: sourceHost, AccountID: "123456789012", Region: "eu-west-3"}
+	tests := []struct {
+		name        string
+		replication Replication
+		source      webhook.Registry
+		want        string
+	}{
+		{"OtherRegion", Replication{Region: "us-east-1"}, source, replicaHost},
+		{"SameRegion", Replication{Region: "eu-west-3"}, source, ""},
+		{"NoClusterRegion", Replication{}, source, ""},
+		{"UnknownRegion", Replication{Region: "us-east-1"}, webhook.Registry{Host: "registry.example.com"}, ""},
+		{"Mapped", Replication{Region: "us-east-1", Registries: map[string]string{sourceHost: "210987654321.dkr.ecr.us-east-1.amazonaws.com"}}, source, "210987654321.dkr.ecr.us-east-1.amazonaws.com"},
+		{"MappedToInvalidHost", Replication{Registries: map[string]string{sourceHost: "registry.example.com"}}, source, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replica, ok := tt.replication.ReplicaFor(tt.source)
+			require.Equal(t, tt.want != "", ok)
+			require.Equal(t, tt.want, replica.Host)
+		})
+	}
+}
+
+func TestReplicaHost(t *testing.T) {
+	source := webhook.Registry{Host: sourceHost, AccountID: "123456789012", Region: "eu-west-3"}
+	tests := []struct {
+		name     string
+		replicas *fakeReplicas
+		source   webhook.Registry
+		want     string
+		fallback bool
+	}{
+		{"Replicated", &fakeReplicas{images: map[string][]string{replicaHost: {"gmt-backend:5d1a9c2"}}}, source, replicaHost, false},
+		{"NotReplicated", &fakeReplicas{images: map[string][]string{replicaHost: {"gmt-backend:bec0e8f"}}}, source, sourceHost, true},
+		{"ReplicaUnavailable", &fakeReplicas{errs: map[string]error{replicaHost: awserr.New("ThrottlingException", "rate exceeded", nil)}}, source, sourceHost, true},
+		{"UnknownRegion", &fakeReplicas{}, webhook.Registry{Host: "registry.example.com"}, "registry.example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Container{ECR: tt.replicas, Replication: &Replication{Region: "us-east-1"}}
+			host, fallback := c.ReplicaHost(context.Background(), tt.source, "gmt-backend:5d1a9c2")
+			require.Equal(t, tt.want, host)
+			require.Equal(t, tt.fallback, fallback != "", fallback)
+		})
+	}
+}
+
+func TestTagUpdateWarnsOfFallback(t *testing.T) {
+	deployment := &appsv1.Deployment{}
+	deployment.Spec.Template.Spec.Containers = []corev1.Container{{Name: "web", Image: sourceHost + "/gmt-backend:5d1a9c2"}}
+	admission := &Admission{
+		Deployment: deployment,
+		Profile:    config.Profile{TagSource: config.TagSourceNone},
+		Registry:   webhook.Registry{Host: sourceHost, AccountID: "123456789012", Region: "eu-west-3"},
+		Image:      "gmt-backend:5d1a9c2",
+	}
+	c := &Container{ECR: &fakeReplicas{}, Replication: &Replication{Region: "us-east-1"}}
+
+	result := (&TagUpdate{Container: c}).Admit(context.Background(), admission)
+	require.NoError(t, result.Err)
+	require.Contains(t, result.Warnings, "image gmt-backend:5d1a9c2 has not replicated to "+replicaHost+" yet, pulling it from "+sourceHost)
+	require.Equal(t, sourceHost+"/gmt-backend:5d1a9c2", admission.Resolution.Image)
+}
@@ -1,30 +1,42 @@
 package function
 
 import (
-	"fmt"
-	"strings"
+	"context"
+	"k8s-update-deployment-ecr-tag/webhook/api/cache"
+	"k8s-update-deployment-ecr-tag/webhook/api/config"
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/webhook"
+	"time"
 
+	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 	log "github.com/sirupsen/logrus"
 )
 
-const seperator = "-"
-
-// Due to our naming convension of repository "project-ptype", e.g.
-// From project-ptype to /project/ptype/tag. ptype can be : frontend, backend.
-func reconstruct(repo string) string {
-	// if !strings.Contains(repo, seperator) {
-	// 	return nil,
-	// }
-	segments := strings.Split(repo, seperator)
-	project, ptype := segments[0], segments[1]
-	log.Tracef("parts: project [%s], type [%s]", project, ptype)
-	return fmt.Sprintf("/%s/%s/ecr_tag", project, ptype)
+// reconstruct returns the parameter holding the tag of the repository, by replacing the
+// fields of the profile's naming template in its parameter prefix; e.g. the repository
+// project-ptype gives /project/ptype/ecr_tag, and /project/ptype/staging/ecr_tag
+// with the prefix /{project}/{type}/{environment}.
+func reconstruct(profile config.Profile, repo string) (string, error) {
+	naming, err := config.ParseNamingTemplate(profile.NamingTemplate)
+	if err != nil {
+		return "", err
+	}
+	name, err := naming.Parameter(profile.ParameterPrefix, profile.Environment, repo)
+	if err != nil {
+		return "", err
+	}
+	log.Tracef("parameter of repository [%s]: [%s]", repo, name)
+	return name, nil
 }
 
 // SSMClient created to use the SSM API
 type SSMClient struct {
 	SSM ssmiface.SSMAPI
+	// Regional, when set, reads the parameters from the region
+	// of the image's registry instead of the default region.
+	Regional SSMProvider
+	// Cache, when set, caches the parameters read.
+	Cache *cache.Cache
 }
 
 // NewSSMClient creates a new SSMClient
@@ -33,3 +45,26 @@ func NewSSMClient(ssmSvc ssmiface.SSMAPI) *SSMClient {
 		SSM: ssmSvc,
 	}
 }
+
+// For returns the SSM client holding the parameters of images from the registry.
+func (s *SSMClient) For(registry webhook.Registry) ssmiface.SSMAPI {
+	client, region := s.SSM, ""
+	if s.Regional != nil && registry.Region != "" {
+		client, region = s.Regional.SSMFor(registry.Region), registry.Region
+	}
+	if s.Cache != nil {
+		return &cachedSSM{SSMAPI: client, cache: s.Cache, region: region}
+	}
+	return client
+}
+
+// GetParameter reads the parameter of images from the registry, returning when it
+// was read from SSM: a while ago when it was cached.
+func (s *SSMClient) GetParameter(ctx context.Context, registry webhook.Registry, input *ssm.GetParameterInput) (*ssm.GetParameterOutput, time.Time, error) {
+	client := s.For(registry)
+	if cached, ok := client.(*cachedSSM); ok {
+		return cached.getParameter(ctx, input)
+	}
+	output, err := client.GetParameterWithContext(ctx, input)
+	return output, time.Now(), err
+}
@@ -0,0 +1,42 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package function
+
+import (
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/webhook"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// VersionLabel is the recommended label holding the version of an application.
+const VersionLabel = "app.kubernetes.io/version"
+
+// versionPatches returns the patch operations injecting the resolved tag, as the profile asks,
+// into the version label of the deployment and its pod template, and into the environment
+// of the containers running the image. Images pinned by digest have no tag to inject.
+func versionPatches(result *Result, a *Admission) []webhook.PatchOperation {
+	deployment, profile, tag := a.Deployment, a.Profile, a.Resolution.Tag
+	if tag == "" || strings.HasPrefix(tag, digestID) {
+		return nil
+	}
+
+	var patch []webhook.PatchOperation
+	if profile.Version.Label {
+		if msgs := validation.IsValidLabelValue(tag); len(msgs) > 0 {
+			log.Warnf("Tag [%s] is not a valid label value, not setting [%s]", tag, VersionLabel)
+			result.Warn("tag %s is not a valid label value, not setting %s: %s", tag, VersionLabel, strings.Join(msgs, "; "))
+		} else {
+			version := map[string]string{VersionLabel: tag}
+			patch = append(patch, webhook.MapPatches("/metadata/labels", deployment.Labels, version)...)
+			patch = append(patch, webhook.MapPatches("/spec/template/metadata/labels", deployment.Spec.Template.Labels, version)...)
+		}
+	}
+	if profile.Version.EnvVar != "" {
+		patch = append(patch, a.EnvPatches(corev1.EnvVar{Name: profile.Version.EnvVar, Value: tag})...)
+	}
+	return patch
+}
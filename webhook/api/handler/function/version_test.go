@@ -0,0 +1,74 @@
+package function
+
+import (
+	"encoding/json"
+	"k8s-update-deployment-ecr-tag/webhook/api/config"
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/webhook"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestVersionPatches(t *testing.T) {
+	const host = "123456789012.dkr.ecr.eu-west-3.amazonaws.com"
+	const image = host + "/gmt-backend:old"
+	bare := func() *appsv1.Deployment {
+		d := &appsv1.Deployment{}
+		d.Spec.Template.Spec.Containers = []corev1.Container{{Name: "web", Image: image}, {Name: "proxy", Image: "envoy"}}
+		return d
+	}
+	labelled := func(version string, env ...corev1.EnvVar) *appsv1.Deployment {
+		d := bare()
+		d.Labels = map[string]string{"app": "gmt", VersionLabel: version}
+		d.Spec.Template.Labels = map[string]string{"app": "gmt"}
+		d.Spec.Template.Spec.Containers[0].Env = env
+		return d
+	}
+	profile := config.Profile{Version: config.VersionInjection{Label: true, EnvVar: "APP_VERSION"}}
+
+	tests := []struct {
+		name       string
+		deployment *appsv1.Deployment
+		tag        string
+		want       string
+		warnings   int
+	}{
+		{"AddLabelsAndEnv", bare(), "5d1a9c2", `[
+			{"op": "add", "path": "/metadata/labels", "value": {"app.kubernetes.io/version": "5d1a9c2"}},
+			{"op": "add", "path": "/spec/template/metadata/labels", "value": {"app.kubernetes.io/version": "5d1a9c2"}},
+			{"op": "add", "path": "/spec/template/spec/containers/0/env", "value": [{"name": "APP_VERSION", "value": "5d1a9c2"}]}
+		]`, 0},
+		{"ReplaceAndAppend", labelled("old", corev1.EnvVar{Name: "LOG_LEVEL", Value: "info"}), "5d1a9c2", `[
+			{"op": "replace", "path": "/metadata/labels/app.kubernetes.io~1version", "value": "5d1a9c2"},
+			{"op": "add", "path": "/spec/template/metadata/labels/app.kubernetes.io~1version", "value": "5d1a9c2"},
+			{"op": "add", "path": "/spec/template/spec/containers/0/env/-", "value": {"name": "APP_VERSION", "value": "5d1a9c2"}}
+		]`, 0},
+		{"ReplaceValueFrom", labelled("5d1a9c2", corev1.EnvVar{Name: "APP_VERSION", ValueFrom: &corev1.EnvVarSource{}}), "5d1a9c2", `[
+			{"op": "add", "path": "/spec/template/metadata/labels/app.kubernetes.io~1version", "value": "5d1a9c2"},
+			{"op": "replace", "path": "/spec/template/spec/containers/0/env/0", "value": {"name": "APP_VERSION", "value": "5d1a9c2"}}
+		]`, 0},
+		{"InvalidLabelValue", bare(), "release+1", `[
+			{"op": "add", "path": "/spec/template/spec/containers/0/env", "value": [{"name": "APP_VERSION", "value": "release+1"}]}
+		]`, 1},
+		{"Digest", bare(), "@sha256:4f53cda18c2baa0c0354bb5f9a3ecbe5ed12ab4d8e11ba873c2f11161202b945", `null`, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var result Result
+			admission := &Admission{
+				Deployment: tt.deployment,
+				Profile:    profile,
+				Registry:   webhook.Registry{Host: host},
+				Image:      "gmt-backend:old",
+				Resolution: &Resolution{Tag: tt.tag},
+			}
+			patch := versionPatches(&result, admission)
+			got, err := json.Marshal(patch)
+			require.NoError(t, err)
+			require.JSONEq(t, tt.want, string(got))
+			require.Len(t, result.Warnings, tt.warnings)
+		})
+	}
+}
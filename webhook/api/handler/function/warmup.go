@@ -0,0 +1,89 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package function
+
+import (
+	"context"
+	"errors"
+	"k8s-update-deployment-ecr-tag/webhook/api/cache"
+	"path"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrNotWarmedUp is returned by the readiness of a Warmer before its first warm-up.
+var ErrNotWarmedUp = errors.New("function: tag parameters not warmed up yet")
+
+// warmupRetry is how soon a failed warm-up is retried, when sooner than the interval.
+const warmupRetry = 10 * time.Second
+
+// Warmer loads the tag parameters of the hierarchies into the SSM cache, on start and on every
+// interval, so that admissions resolve tags from memory. The parameters loaded are cached for the
+// cache's TTL, like those read by admissions, lest a tag updated in SSM is served for longer.
+type Warmer struct {
+	// SSM reads the parameters of the default region.
+	SSM      ssmiface.SSMAPI
+	Cache    *cache.Cache
+	Paths    []string
+	Interval time.Duration
+
+	warmed int32
+}
+
+// Run warms the cache up until the context is done.
+func (w *Warmer) Run(ctx context.Context) {
+	for {
+		next := w.Interval
+		if err := w.Warm(ctx); err != nil {
+			log.Warnf("Error warming the tag parameters up: %v", err)
+			if next > warmupRetry {
+				next = warmupRetry
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(next):
+		}
+	}
+}
+
+// Warm loads the tag parameters of every hierarchy into the cache.
+func (w *Warmer) Warm(ctx context.Context) error {
+	start := time.Now()
+	loaded := 0
+	for _, hierarchy := range w.Paths {
+		input := &ssm.GetParametersByPathInput{Path: aws.String(hierarchy), Recursive: aws.Bool(true)}
+		err := w.SSM.GetParametersByPathPagesWithContext(ctx, input, func(output *ssm.GetParametersByPathOutput, _ bool) bool {
+			for _, parameter := range output.Parameters {
+				if path.Base(aws.StringValue(parameter.Name)) != tagParameter {
+					continue
+				}
+				key := getParameterKey("", &ssm.GetParameterInput{Name: parameter.Name})
+				w.Cache.Set(key, &ssm.GetParameterOutput{Parameter: parameter})
+				loaded++
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt32(&w.warmed, 1)
+	log.Infof("Warmed %d tag parameters up in %s", loaded, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// Ready returns ErrNotWarmedUp until the first warm-up succeeded.
+func (w *Warmer) Ready() error {
+	if atomic.LoadInt32(&w.warmed) == 0 {
+		return ErrNotWarmedUp
+	}
+	return nil
+}
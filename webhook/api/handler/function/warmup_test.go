@@ -0,0 +1,75 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"k8s-update-deployment-ecr-tag/webhook/api/cache"
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/webhook"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/stretchr/testify/require"
+)
+
+// pagedSSM serves the parameters of a hierarchy in pages of one, and fails to read single parameters.
+type pagedSSM struct {
+	ssmiface.SSMAPI
+	parameters []*ssm.Parameter
+	err        error
+}
+
+func (p *pagedSSM) GetParametersByPathPagesWithContext(_ aws.Context, _ *ssm.GetParametersByPathInput, fn func(*ssm.GetParametersByPathOutput, bool) bool, _ ...request.Option) error {
+	if p.err != nil {
+		return p.err
+	}
+	for i, parameter := range p.parameters {
+		if !fn(&ssm.GetParametersByPathOutput{Parameters: []*ssm.Parameter{parameter}}, i == len(p.parameters)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func (p *pagedSSM) GetParameterWithContext(aws.Context, *ssm.GetParameterInput, ...request.Option) (*ssm.GetParameterOutput, error) {
+	return nil, errors.New("the parameter should have been warmed up")
+}
+
+func TestWarmer(t *testing.T) {
+	svc := &pagedSSM{err: errors.New("rate exceeded")}
+	lookups := cache.New(ssmCache, time.Second, time.Second, 0, nil)
+	w := &Warmer{SSM: svc, Cache: lookups, Paths: []string{"/gmt"}, Interval: time.Minute}
+
+	require.Error(t, w.Warm(context.Background()))
+	require.Equal(t, ErrNotWarmedUp, w.Ready())
+
+	svc.err = nil
+	svc.parameters = []*ssm.Parameter{
+		{Name: aws.String("/gmt/backend/ecr_tag"), Value: aws.String("5d1a9c2"), Version: aws.Int64(4)},
+		{Name: aws.String("/gmt/backend/log-level"), Value: aws.String("info")},
+	}
+	require.NoError(t, w.Warm(context.Background()))
+	require.NoError(t, w.Ready())
+
+	client := (&SSMClient{SSM: svc, Cache: lookups}).For(webhook.Registry{})
+	output, err := client.GetParameterWithContext(context.Background(), &ssm.GetParameterInput{Name: aws.String("/gmt/backend/ecr_tag")})
+	require.NoError(t, err)
+	require.Equal(t, "5d1a9c2", aws.StringValue(output.Parameter.Value))
+	_, err = client.GetParameterWithContext(context.Background(), &ssm.GetParameterInput{Name: aws.String("/gmt/backend/log-level")})
+	require.Error(t, err, "only tag parameters are warmed up")
+}
+
+func TestWarmerKeepsCacheTTL(t *testing.T) {
+	svc := &pagedSSM{parameters: []*ssm.Parameter{{Name: aws.String("/gmt/backend/ecr_tag"), Value: aws.String("5d1a9c2")}}}
+	lookups := cache.New(ssmCache, 10*time.Millisecond, time.Second, 0, nil)
+	w := &Warmer{SSM: svc, Cache: lookups, Paths: []string{"/gmt"}, Interval: time.Minute}
+	require.NoError(t, w.Warm(context.Background()))
+
+	time.Sleep(20 * time.Millisecond)
+	client := (&SSMClient{SSM: svc, Cache: lookups}).For(webhook.Registry{})
+	_, err := client.GetParameterWithContext(context.Background(), &ssm.GetParameterInput{Name: aws.String("/gmt/backend/ecr_tag")})
+	require.Error(t, err, "warmed up parameters expire with the cache's TTL, not the interval")
+}
@@ -13,54 +13,139 @@
 package handler
 
 import (
+	"context"
+	"k8s-update-deployment-ecr-tag/webhook/api/audit"
+	"k8s-update-deployment-ecr-tag/webhook/api/breaker"
+	"k8s-update-deployment-ecr-tag/webhook/api/config"
 	"k8s-update-deployment-ecr-tag/webhook/api/handler/function"
-	"os"
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/tagpolicy"
+	"k8s-update-deployment-ecr-tag/webhook/api/metrics"
+	"k8s-update-deployment-ecr-tag/webhook/api/tracing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/aws/aws-sdk-go/service/ssm"
 	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
 )
 
-func init() {
-	loglvl := logLevels(os.Getenv("LOG_LEVEL")) // TODO: Set LOG_LEVEL environment variable
-	log.SetFormatter(new(log.JSONFormatter))
-	log.Infof("Got log level [%s]", loglvl)
-	log.SetLevel(loglvl)
-}
-
 var (
-	sess = session.Must(session.NewSession())
-
-	svc    = ecr.New(sess, &aws.Config{Region: getRegistryRegion()})
-	ssmSvc = ssm.New(sess, &aws.Config{Region: getRegistryRegion()})
-
-	// Handler is the handler for the validating webhook.
-	Handler = function.NewContainer(svc, ssmSvc).Handler().WithLogging()
-
 	// Version is the shortened git hash of the binary's source code.
 	// It is injected using the -X linker flag when running `make`
 	Version string
 )
 
-// func main() {
-// 	log.Infof("Starting function version: %s", Version)
-// 	lambda.Start(Handler)
-// }
+// Webhook is the handler of the mutating webhook along with its readiness.
+type Webhook struct {
+	Handler function.Handler
+	// Ready returns an error until the webhook can serve admissions promptly;
+	// e.g. before the tag parameters are warmed up.
+	Ready func() error
+	// Credentials returns an error while the AWS credentials cannot be retrieved.
+	Credentials func(context.Context) error
+	// Audit is the trail of the decisions; nil when disabled.
+	Audit *audit.Store
+}
 
-func logLevels(lvl string) log.Level {
-	loglvl, err := log.ParseLevel(lvl)
+// New creates the handler for the mutating webhook from the configuration,
+// applying the policies of the source to admissions. Background watches of
+// the cluster stop when the context is done.
+func New(ctx context.Context, cfg *config.Config, policies config.PolicySource) (*Webhook, error) {
+	// Throttled and failed calls are retried with the SDK's jittered backoff, capped
+	// for the retries to fit in the deadline of an admission.
+	sess, err := session.NewSession(&aws.Config{Retryer: client.DefaultRetryer{
+		NumMaxRetries:    cfg.AWS.MaxRetries,
+		MaxRetryDelay:    time.Second,
+		MaxThrottleDelay: 2 * time.Second,
+	}})
 	if err != nil {
-		return log.InfoLevel
+		return nil, err
+	}
+	metrics.InstrumentAWS(&sess.Handlers)
+	if cfg.AWS.CircuitBreaker.Failures > 0 {
+		breaker.NewBreakers(cfg.AWS.CircuitBreaker.Failures, cfg.AWS.CircuitBreaker.Cooldown.Duration).Install(&sess.Handlers)
 	}
+	// Installed last, for the span to start before a breaker fails the call.
+	tracing.InstrumentAWS(&sess.Handlers)
+	ready := func() error { return nil }
 
-	return loglvl
-}
+	region := aws.String(cfg.AWS.Region)
+	svc := function.NewECRClients(sess, region, cfg.AWS.AccountRoles)
+	ssmSvc := ssm.New(sess, &aws.Config{Region: region})
+
+	container := function.NewContainer(cfg, svc, ssmSvc)
+	container.Policies = policies
+	var trail *audit.Store
+	if cfg.AuditTrail.Dir != "" {
+		if trail, err = audit.NewStore(cfg.AuditTrail.Dir, cfg.AuditTrail.MaxFileSize, cfg.AuditTrail.MaxFiles); err != nil {
+			return nil, err
+		}
+		container.Audit = trail
+	}
 
-func getRegistryRegion() *string {
-	if value, ok := os.LookupEnv("REGISTRY_REGION"); ok {
-		return aws.String(value)
+	var snapshot function.TagSnapshot
+	if cfg.LastKnownTags.SnapshotFile != "" {
+		snapshot = &function.FileSnapshot{Path: cfg.LastKnownTags.SnapshotFile}
+	}
+
+	restConfig, err := newRestConfig()
+	if err != nil {
+		return nil, err
+	}
+	if restConfig != nil {
+		client, err := kubernetes.NewForConfig(restConfig)
+		if err != nil {
+			return nil, err
+		}
+		namespaces, err := newNamespaceLister(ctx, client)
+		if err != nil {
+			return nil, err
+		}
+		container.Namespaces = namespaces
+		if cfg.LastKnownTags.SnapshotConfigMap != "" {
+			namespace, name, err := cfg.LastKnownTags.ConfigMap()
+			if err != nil {
+				return nil, err
+			}
+			snapshot = &configMapSnapshot{client: client, namespace: namespace, name: name}
+		}
+
+		if cfg.TagPolicies {
+			dynamicClient, err := dynamic.NewForConfig(restConfig)
+			if err != nil {
+				return nil, err
+			}
+			store, err := tagpolicy.NewStore(ctx, dynamicClient)
+			if err != nil {
+				return nil, err
+			}
+			container.TagPolicies = store
+		}
+	}
+	if snapshot != nil {
+		tags, err := snapshot.Load(ctx)
+		if err != nil {
+			log.Warnf("Error loading the last known tags, starting without them: %v", err)
+		}
+		container.LastKnown.Restore(tags)
+		go container.LastKnown.Persist(ctx, snapshot, cfg.LastKnownTags.SnapshotInterval.Duration)
+	}
+	if len(cfg.Warmup.Paths) > 0 {
+		warmer := &function.Warmer{SSM: ssmSvc, Cache: container.SSMClient.Cache, Paths: cfg.Warmup.Paths, Interval: cfg.Warmup.Interval.Duration}
+		go warmer.Run(ctx)
+		ready = warmer.Ready
+	}
+	// Parameters are read from the default region unless configured
+	// to be read from the region of the image's registry.
+	if cfg.AWS.SSMRegionFromImage {
+		container.SSMClient.Regional = function.NewSSMClients(sess)
+	}
+	credentials := func(ctx context.Context) error {
+		_, err := sess.Config.Credentials.GetWithContext(ctx)
+		return err
 	}
-	return aws.String(os.Getenv("AWS_DEFAULT_REGION"))
+	return &Webhook{Handler: container.Handler(), Ready: ready, Credentials: credentials, Audit: trail}, nil
 }
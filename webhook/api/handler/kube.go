@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+// namespaceLister serves the labels of namespaces from an informer's cache.
+type namespaceLister struct {
+	lister corelisters.NamespaceLister
+}
+
+// Labels returns the labels of the namespace.
+func (n *namespaceLister) Labels(name string) (map[string]string, error) {
+	namespace, err := n.lister.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return namespace.Labels, nil
+}
+
+// newRestConfig returns the configuration of the cluster the webhook runs in.
+// A nil configuration is returned when the webhook does not run in a cluster.
+func newRestConfig() (*rest.Config, error) {
+	restConfig, err := rest.InClusterConfig()
+	if err == rest.ErrNotInCluster {
+		log.Warn("Not running in a cluster, namespace selectors and tag policies are unavailable")
+		return nil, nil
+	}
+	return restConfig, err
+}
+
+// newNamespaceLister watches the namespaces of the cluster until the context is done.
+func newNamespaceLister(ctx context.Context, client kubernetes.Interface) (*namespaceLister, error) {
+	factory := informers.NewSharedInformerFactory(client, 0)
+	informer := factory.Core().V1().Namespaces()
+	lister := informer.Lister()
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.Informer().HasSynced) {
+		return nil, fmt.Errorf("handler: namespaces cache did not sync")
+	}
+	return &namespaceLister{lister: lister}, nil
+}
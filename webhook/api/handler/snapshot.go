@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/function"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// snapshotKey is the key of the ConfigMap holding the last known tags.
+const snapshotKey = "last-known-tags.json"
+
+// configMapSnapshot persists the last known tags to a ConfigMap, created on the first save.
+type configMapSnapshot struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+}
+
+// Load reads the tags of the ConfigMap, none when it does not exist yet.
+func (s *configMapSnapshot) Load(ctx context.Context) (map[string]function.KnownTag, error) {
+	cm, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	content, ok := cm.Data[snapshotKey]
+	if !ok {
+		return nil, nil
+	}
+	var tags map[string]function.KnownTag
+	if err := json.Unmarshal([]byte(content), &tags); err != nil {
+		return nil, fmt.Errorf("handler: parsing last known tags %s/%s: %w", s.namespace, s.name, err)
+	}
+	return tags, nil
+}
+
+// Save replaces the tags of the ConfigMap.
+func (s *configMapSnapshot) Save(ctx context.Context, tags map[string]function.KnownTag) error {
+	content, err := json.Marshal(tags)
+	if err != nil {
+		return err
+	}
+	configMaps := s.client.CoreV1().ConfigMaps(s.namespace)
+	cm, err := configMaps.Get(ctx, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: s.namespace, Name: s.name}}
+		cm.Data = map[string]string{snapshotKey: string(content)}
+		_, err = configMaps.Create(ctx, cm, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if cm.Data == nil {
+		cm.Data = make(map[string]string)
+	}
+	cm.Data[snapshotKey] = string(content)
+	_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+	return err
+}
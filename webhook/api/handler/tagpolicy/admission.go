@@ -0,0 +1,50 @@
+package tagpolicy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/webhook"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/admission/v1"
+)
+
+// ErrUnexpectedResource is returned when the validating webhook admits another resource than TagPolicy.
+var ErrUnexpectedResource = errors.New("tagpolicy: expected TagPolicy resource")
+
+// HTTP status code returned when an invalid TagPolicy is rejected
+const code = http.StatusUnprocessableEntity
+
+// Validate is the handler of the validating webhook admitting TagPolicy resources,
+// denying those whose spec is invalid.
+func Validate(ctx context.Context, event *http.Request) (*v1.AdmissionReview, error) {
+	request, err := webhook.NewRequestFromEvent(event)
+	if err != nil {
+		log.Errorf("Error creating request from event: %v", err)
+		return webhook.BadRequestResponse(err)
+	}
+
+	response, err := webhook.NewResponseFromRequest(request)
+	if err != nil {
+		log.Errorf("Error crafting response from request: %v", err)
+		return webhook.BadRequestResponse(err)
+	}
+
+	if request.Admission.Kind.Kind != Kind {
+		return response.FailValidation(code, ErrUnexpectedResource)
+	}
+	if len(request.Admission.Object.Raw) == 0 {
+		return response.FailValidation(code, webhook.ErrObjectNotFound)
+	}
+	var policy TagPolicy
+	if err := json.Unmarshal(request.Admission.Object.Raw, &policy); err != nil {
+		return response.FailValidation(code, err)
+	}
+	if err := policy.Spec.Validate(); err != nil {
+		log.Infof("Denying invalid TagPolicy [%s/%s]: %v", request.Admission.Namespace, policy.Name, err)
+		return response.FailValidation(code, err)
+	}
+	return response.PassValidationWithMessage("tag policy is valid")
+}
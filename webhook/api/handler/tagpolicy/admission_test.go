@@ -0,0 +1,50 @@
+package tagpolicy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		allowed bool
+	}{
+		{"Valid", `{"namingTemplate": "{team}/{project}", "parameterPrefix": "/{team}/{project}/{environment}", "failMode": "open"}`, true},
+		{"Empty", `{}`, true},
+		{"DefaultNamingTemplate", `{"parameterPrefix": "/{project}/{type}"}`, true},
+		{"UnknownPrefixField", `{"namingTemplate": "{team}/{project}", "parameterPrefix": "/{team}/{type}"}`, false},
+		{"InvalidSelector", `{"selector": {"matchExpressions": [{"key": "tier", "operator": "Maybe"}]}}`, false},
+		{"InvalidFailMode", `{"failMode": "sometimes"}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			review := v1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+				Request: &v1.AdmissionRequest{
+					UID:       "tagpolicy",
+					Kind:      metav1.GroupVersionKind{Group: Group, Version: Version, Kind: Kind},
+					Namespace: "team-a",
+					Object:    runtime.RawExtension{Raw: []byte(`{"metadata": {"name": "default"}, "spec": ` + tt.spec + `}`)},
+				},
+			}
+			body, err := json.Marshal(review)
+			require.NoError(t, err)
+			req := httptest.NewRequest("POST", "/validate-tagpolicy", strings.NewReader(string(body)))
+			req.Header.Set("Content-Type", "application/json")
+
+			got, err := Validate(context.Background(), req)
+			require.NoError(t, err)
+			require.Equal(t, tt.allowed, got.Response.Allowed, got.Response.Result.Message)
+		})
+	}
+}
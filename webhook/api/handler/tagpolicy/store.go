@@ -0,0 +1,118 @@
+package tagpolicy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Store serves the TagPolicy resources of the cluster from an informer's cache,
+// and reports whether each policy is accepted in its status.
+type Store struct {
+	client dynamic.Interface
+	lister cache.GenericLister
+}
+
+// NewStore watches the TagPolicy resources of the cluster until the context is done.
+func NewStore(ctx context.Context, client dynamic.Interface) (*Store, error) {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, 0)
+	informer := factory.ForResource(GroupVersionResource)
+	s := &Store{client: client, lister: informer.Lister()}
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { s.reconcile(ctx, obj) },
+		UpdateFunc: func(_, obj interface{}) { s.reconcile(ctx, obj) },
+	})
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.Informer().HasSynced) {
+		return nil, fmt.Errorf("tagpolicy: tag policies cache did not sync")
+	}
+	return s, nil
+}
+
+// For returns the valid TagPolicy of the deployment's namespace whose selector matches
+// the deployment, the first by name when several do, or nil when none does.
+func (s *Store) For(deployment *appsv1.Deployment) (*TagPolicy, error) {
+	objs, err := s.lister.ByNamespace(deployment.Namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	var matched []*TagPolicy
+	for _, obj := range objs {
+		policy, err := FromUnstructured(obj.(*unstructured.Unstructured))
+		if err != nil {
+			log.Warn(err)
+			continue
+		}
+		if err := policy.Spec.Validate(); err != nil {
+			log.Debugf("Skipping invalid TagPolicy [%s/%s]: %v", policy.Namespace, policy.Name, err)
+			continue
+		}
+		if ok, _ := policy.Spec.Matches(deployment.Labels); ok {
+			matched = append(matched, policy)
+		}
+	}
+	if len(matched) == 0 {
+		return nil, nil
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].Name < matched[j].Name })
+	if len(matched) > 1 {
+		log.Warnf("%d TagPolicies match deployment [%s/%s], applying [%s]",
+			len(matched), deployment.Namespace, deployment.Name, matched[0].Name)
+	}
+	return matched[0], nil
+}
+
+// reconcile validates the policy and records the outcome in its Accepted condition,
+// updating the status only when the condition changed.
+func (s *Store) reconcile(ctx context.Context, obj interface{}) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	policy, err := FromUnstructured(u)
+	if err != nil {
+		log.Warn(err)
+		return
+	}
+
+	condition := metav1.Condition{
+		Type:               ConditionAccepted,
+		Status:             metav1.ConditionTrue,
+		Reason:             ReasonValid,
+		Message:            "The policy applies to the deployments it selects",
+		ObservedGeneration: policy.Generation,
+	}
+	if err := policy.Spec.Validate(); err != nil {
+		condition.Status, condition.Reason, condition.Message = metav1.ConditionFalse, ReasonInvalid, err.Error()
+	}
+	if current := meta.FindStatusCondition(policy.Status.Conditions, ConditionAccepted); current != nil &&
+		current.Status == condition.Status && current.Reason == condition.Reason &&
+		current.Message == condition.Message && current.ObservedGeneration == condition.ObservedGeneration {
+		return
+	}
+	meta.SetStatusCondition(&policy.Status.Conditions, condition)
+	policy.Status.ObservedGeneration = policy.Generation
+
+	updated, err := ToUnstructured(policy)
+	if err != nil {
+		log.Warn(err)
+		return
+	}
+	_, err = s.client.Resource(GroupVersionResource).Namespace(policy.Namespace).UpdateStatus(ctx, updated, metav1.UpdateOptions{})
+	if err != nil {
+		// A conflicting update is retried on the next event of the policy.
+		log.Warnf("Error updating the status of TagPolicy [%s/%s]: %v", policy.Namespace, policy.Name, err)
+		return
+	}
+	log.Infof("TagPolicy [%s/%s] %s: %s", policy.Namespace, policy.Name, condition.Reason, condition.Message)
+}
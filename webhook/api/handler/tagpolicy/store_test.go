@@ -0,0 +1,87 @@
+package tagpolicy
+
+import (
+	"context"
+	"k8s-update-deployment-ecr-tag/webhook/api/config"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+func newTagPolicy(t *testing.T, namespace, name string, spec Spec) runtime.Object {
+	obj, err := ToUnstructured(&TagPolicy{
+		TypeMeta:   metav1.TypeMeta{APIVersion: Group + "/" + Version, Kind: Kind},
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Generation: 1},
+		Spec:       spec,
+	})
+	require.NoError(t, err)
+	return obj
+}
+
+func TestStore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{GroupVersionResource: Kind + "List"},
+		newTagPolicy(t, "team-a", "frontend", Spec{
+			Selector:  &metav1.LabelSelector{MatchLabels: map[string]string{"tier": "frontend"}},
+			Overrides: config.Overrides{TagSource: config.TagSourceNone},
+		}),
+		newTagPolicy(t, "team-a", "default", Spec{
+			Overrides: config.Overrides{NamingTemplate: "{project}.{type}", FailMode: config.FailOpen},
+		}),
+		newTagPolicy(t, "team-b", "broken", Spec{
+			Overrides: config.Overrides{TagSource: "vault"},
+		}),
+	)
+	store, err := NewStore(ctx, client)
+	require.NoError(t, err)
+
+	deployment := func(namespace string, labels map[string]string) *appsv1.Deployment {
+		return &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "echo", Labels: labels}}
+	}
+
+	policy, err := store.For(deployment("team-a", map[string]string{"tier": "frontend"}))
+	require.NoError(t, err)
+	require.Equal(t, "default", policy.Name, "the first policy by name applies")
+
+	defaults := config.DefaultPolicy()
+	profile := policy.Apply(defaults.Profile(nil))
+	require.Equal(t, "team-a/default", profile.TagPolicy)
+	require.Equal(t, "{project}.{type}", profile.NamingTemplate)
+	require.Equal(t, config.FailOpen, profile.FailMode)
+	require.Equal(t, config.TagSourceSSM, profile.TagSource, "unset fields keep the cluster defaults")
+
+	policy, err = store.For(deployment("team-b", nil))
+	require.NoError(t, err)
+	require.Nil(t, policy, "invalid policies are not applied")
+
+	policy, err = store.For(deployment("team-c", nil))
+	require.NoError(t, err)
+	require.Nil(t, policy)
+
+	accepted := func(namespace, name string) *metav1.Condition {
+		obj, err := client.Resource(GroupVersionResource).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		policy, err := FromUnstructured(obj)
+		require.NoError(t, err)
+		return meta.FindStatusCondition(policy.Status.Conditions, ConditionAccepted)
+	}
+	require.Eventually(t, func() bool { return accepted("team-a", "frontend") != nil }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, metav1.ConditionTrue, accepted("team-a", "frontend").Status)
+
+	require.Eventually(t, func() bool { return accepted("team-b", "broken") != nil }, 5*time.Second, 10*time.Millisecond)
+	condition := accepted("team-b", "broken")
+	require.Equal(t, metav1.ConditionFalse, condition.Status)
+	require.Equal(t, ReasonInvalid, condition.Reason)
+	require.Contains(t, condition.Message, `spec.tagSource: unknown tag source "vault"`)
+	require.Equal(t, int64(1), condition.ObservedGeneration)
+}
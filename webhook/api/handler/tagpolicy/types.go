@@ -0,0 +1,111 @@
+// Package tagpolicy contains the TagPolicy custom resource, through which teams
+// tune the profile applied to the deployments of their namespace.
+package tagpolicy
+
+import (
+	"fmt"
+	"k8s-update-deployment-ecr-tag/webhook/api/config"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// The API of the TagPolicy resource.
+const (
+	Group    = "ecr-tag.brilliantsolutions.com"
+	Version  = "v1alpha1"
+	Kind     = "TagPolicy"
+	Resource = "tagpolicies"
+)
+
+// GroupVersionResource identifies TagPolicy resources to the dynamic client.
+var GroupVersionResource = schema.GroupVersionResource{Group: Group, Version: Version, Resource: Resource}
+
+// Condition types and reasons reported in the status of a TagPolicy.
+const (
+	// ConditionAccepted is true when the policy is valid and applied to deployments.
+	ConditionAccepted = "Accepted"
+	ReasonValid       = "Valid"
+	ReasonInvalid     = "Invalid"
+)
+
+// TagPolicy overrides, for the deployments of its namespace matching its selector,
+// the settings of the profile the cluster policy gives them.
+type TagPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   Spec   `json:"spec"`
+	Status Status `json:"status,omitempty"`
+}
+
+// Spec is the desired behavior of a TagPolicy.
+type Spec struct {
+	// Selector restricts the policy to the deployments whose labels match;
+	// the policy applies to every deployment of its namespace when nil.
+	Selector         *metav1.LabelSelector `json:"selector,omitempty"`
+	config.Overrides `json:",inline"`
+}
+
+// Status is the observed state of a TagPolicy.
+type Status struct {
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// Validate checks the spec, reporting every invalid field at once.
+func (s *Spec) Validate() error {
+	var errs config.ValidationError
+	if s.Selector != nil {
+		if _, err := metav1.LabelSelectorAsSelector(s.Selector); err != nil {
+			errs = append(errs, fmt.Sprintf("spec.selector: %v", err))
+		}
+	}
+	if err := s.Overrides.Validate("spec"); err != nil {
+		errs = append(errs, err.(config.ValidationError)...)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Matches checks that the selector of the policy matches the labels.
+func (s *Spec) Matches(objectLabels map[string]string) (bool, error) {
+	if s.Selector == nil {
+		return true, nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(s.Selector)
+	if err != nil {
+		return false, err
+	}
+	return selector.Matches(labels.Set(objectLabels)), nil
+}
+
+// Apply returns the profile overridden by the policy.
+func (p *TagPolicy) Apply(profile config.Profile) config.Profile {
+	profile = p.Spec.Overrides.Apply(profile)
+	profile.TagPolicy = p.Namespace + "/" + p.Name
+	return profile
+}
+
+// FromUnstructured converts an object of the dynamic client into a TagPolicy.
+func FromUnstructured(obj *unstructured.Unstructured) (*TagPolicy, error) {
+	var policy TagPolicy
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &policy); err != nil {
+		return nil, fmt.Errorf("tagpolicy: converting %s/%s: %w", obj.GetNamespace(), obj.GetName(), err)
+	}
+	return &policy, nil
+}
+
+// ToUnstructured converts the TagPolicy into an object of the dynamic client.
+func ToUnstructured(policy *TagPolicy) (*unstructured.Unstructured, error) {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(policy)
+	if err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: obj}, nil
+}
@@ -68,3 +68,52 @@ func newDeploymentWithImage(image string) *appsv1.Deployment {
 		},
 	}
 }
+
+func TestParseRegistry(t *testing.T) {
+	tests := []struct {
+		name    string
+		host    string
+		want    Registry
+		wantErr error
+	}{
+		{"Commercial", "273450712882.dkr.ecr.us-east-2.amazonaws.com", Registry{Host: "273450712882.dkr.ecr.us-east-2.amazonaws.com", AccountID: "273450712882", Region: "us-east-2"}, nil},
+		{"CN", "273450712882.dkr.ecr.cn-north-1.amazonaws.com.cn", Registry{Host: "273450712882.dkr.ecr.cn-north-1.amazonaws.com.cn", AccountID: "273450712882", Region: "cn-north-1"}, nil},
+		{"FIPS", "273450712882.dkr.ecr-fips.us-east-2.amazonaws.com", Registry{Host: "273450712882.dkr.ecr-fips.us-east-2.amazonaws.com", AccountID: "273450712882", Region: "us-east-2"}, nil},
+		{"NotECR", "quay.io", Registry{}, ErrNotECRRegistry},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRegistry(tt.host)
+			if err != tt.wantErr {
+				t.Fatalf("ParseRegistry() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseRegistry() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeImage(t *testing.T) {
+	tests := []struct {
+		name     string
+		image    string
+		wantHost string
+		wantPath string
+	}{
+		{"ShortName", "nginx:1.19", "docker.io", "library/nginx:1.19"},
+		{"Organization", "bitnami/redis:6.0", "docker.io", "bitnami/redis:6.0"},
+		{"DockerHubAlias", "index.docker.io/library/nginx", "docker.io", "library/nginx"},
+		{"Quay", "quay.io/kubernetes-ingress-controller/nginx-ingress-controller:0.30.0", "quay.io", "kubernetes-ingress-controller/nginx-ingress-controller:0.30.0"},
+		{"GHCR", "ghcr.io/org/app@sha256:e5e2a3236e64483c50dd2811e46e9cd49c67e82271e60d112ca69a075fc23005", "ghcr.io", "org/app@sha256:e5e2a3236e64483c50dd2811e46e9cd49c67e82271e60d112ca69a075fc23005"},
+		{"Localhost", "localhost/app:1", "localhost", "app:1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, path := NormalizeImage(tt.image)
+			if host != tt.wantHost || path != tt.wantPath {
+				t.Errorf("NormalizeImage() = %s, %s, want %s, %s", host, path, tt.wantHost, tt.wantPath)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package webhook
+
+import (
+	"regexp"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Redacted replaces the values kept out of the logs.
+const Redacted = "[redacted]"
+
+// envValuePath matches the paths of the values of environment variables.
+var envValuePath = regexp.MustCompile(`/env/[0-9]+/value$`)
+
+// RedactPatch returns a copy of the patch safe to log: the values of the environment
+// variables it sets are redacted, their names and references to secrets kept.
+func RedactPatch(patch []PatchOperation) []PatchOperation {
+	redacted := make([]PatchOperation, len(patch))
+	for i, op := range patch {
+		switch value := op.Value.(type) {
+		case corev1.EnvVar:
+			op.Value = redactEnv(value)
+		case []corev1.EnvVar:
+			env := make([]corev1.EnvVar, len(value))
+			for j, e := range value {
+				env[j] = redactEnv(e)
+			}
+			op.Value = env
+		case string:
+			if envValuePath.MatchString(op.Path) {
+				op.Value = Redacted
+			}
+		}
+		redacted[i] = op
+	}
+	return redacted
+}
+
+func redactEnv(e corev1.EnvVar) corev1.EnvVar {
+	if e.Value != "" {
+		e.Value = Redacted
+	}
+	return e
+}
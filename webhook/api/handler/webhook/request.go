@@ -6,15 +6,15 @@ package webhook
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
-	"os"
 	"regexp"
 	"strings"
 
 	v1 "k8s.io/api/admission/v1"
 	appsv1 "k8s.io/api/apps/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
@@ -32,23 +32,37 @@ var (
 	ErrObjectNotFound     = errors.New("webhook: request did not include object")
 	ErrUnexpectedResource = errors.New("webhook: expected deployment resource")
 	ErrInvalidAdmission   = errors.New("webhook: admission request was nil")
+	ErrNotECRRegistry     = errors.New("webhook: registry is not an ecr registry")
 )
 
 var (
 	runtimeScheme     = runtime.NewScheme()
 	codecs            = serializer.NewCodecFactory(runtimeScheme)
 	deserializer      = codecs.UniversalDeserializer()
-	ignoredNamespaces = []string{
-		metav1.NamespaceSystem,
-	}
-	deploymentNamespace = os.Getenv("DEPLOYMENT_NAMESPACE") // TODO: this is the name of the current deployment namespace
-	deploymentDefault   = &schema.GroupVersionKind{
+	deploymentDefault = &schema.GroupVersionKind{
 		Group:   "apps",
 		Version: "v1",
 		Kind:    "Deployment",
 	}
 )
 
+// Registry identifies the Amazon ECR registry an image is pulled from.
+type Registry struct {
+	Host      string
+	AccountID string
+	Region    string
+}
+
+// ParseRegistry extracts the registry's account ID and region from its host;
+// e.g. aws_account_id.dkr.ecr.aws_region.amazonaws.com.
+func ParseRegistry(host string) (Registry, error) {
+	matches := ECRImageRegex.FindStringSubmatch(host)
+	if matches == nil {
+		return Registry{}, ErrNotECRRegistry
+	}
+	return Registry{Host: host, AccountID: matches[1], Region: matches[3]}, nil
+}
+
 // Request encapsulates the AdmissionRequest from the
 // AdmissionReview proxied to the Lambda function.
 type Request struct {
@@ -99,7 +113,7 @@ func (r *Request) UnmarshalDeployment() (*appsv1.Deployment, error) {
 
 // InCriticalNamespace checks that the request was for a resource
 // that is being deployed into a critical namespace; e.g. kube-system.
-func InCriticalNamespace(deployment *appsv1.Deployment) bool {
+func InCriticalNamespace(deployment *appsv1.Deployment, ignoredNamespaces []string) bool {
 	for _, n := range ignoredNamespaces {
 		if deployment.Namespace == n {
 			return true
@@ -111,10 +125,44 @@ func InCriticalNamespace(deployment *appsv1.Deployment) bool {
 // NotInDeploymentNamespace checks that the request was for a resource
 // that is being deployed into a non deployment namespace;
 // TODO: This condition may removed later
-func NotInDeploymentNamespace(deployment *appsv1.Deployment) bool {
+func NotInDeploymentNamespace(deployment *appsv1.Deployment, deploymentNamespace string) bool {
 	return deployment.Namespace != deploymentNamespace
 }
 
+// ContainerImage is the image of a container in the Deployment's pod template,
+// along with the JSON patch path of that image.
+type ContainerImage struct {
+	Name  string
+	Path  string
+	Image string
+	Env   []corev1.EnvVar
+}
+
+// ContainerImages returns the images of every container and init container
+// in the Deployment's pod template.
+func ContainerImages(deployment *appsv1.Deployment) []ContainerImage {
+	var images []ContainerImage
+	for i, c := range deployment.Spec.Template.Spec.Containers {
+		images = append(images, ContainerImage{Name: c.Name, Path: fmt.Sprintf("/spec/template/spec/containers/%d/image", i), Image: c.Image, Env: c.Env})
+	}
+	for i, c := range deployment.Spec.Template.Spec.InitContainers {
+		images = append(images, ContainerImage{Name: c.Name, Path: fmt.Sprintf("/spec/template/spec/initContainers/%d/image", i), Image: c.Image, Env: c.Env})
+	}
+	return images
+}
+
+// ImagePatches returns the patch operations replacing every occurrence
+// of the image in the Deployment's pod template.
+func ImagePatches(deployment *appsv1.Deployment, image, replacement string) []PatchOperation {
+	var patch []PatchOperation
+	for _, c := range ContainerImages(deployment) {
+		if c.Image == image {
+			patch = append(patch, ReplaceImage(c.Path, replacement))
+		}
+	}
+	return patch
+}
+
 // ParseImages returns the container images in the Deployment spec
 // that originate from an Amazon ECR repository.
 func ParseImages(deployment *appsv1.Deployment) (string, []string) {
@@ -159,3 +207,24 @@ func contains(images []string, image string) bool {
 	}
 	return false
 }
+
+// Docker Hub is the registry of images that do not name one.
+const dockerHub = "docker.io"
+
+// NormalizeImage splits an image into its registry host and repository path, expanding
+// Docker Hub short names; e.g. nginx:1.19 to docker.io and library/nginx:1.19.
+func NormalizeImage(image string) (string, string) {
+	host, path := dockerHub, image
+	if segments := strings.SplitN(image, "/", 2); len(segments) == 2 &&
+		(strings.ContainsAny(segments[0], ".:") || segments[0] == "localhost") {
+		host, path = segments[0], segments[1]
+	}
+	switch host {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		host = dockerHub
+	}
+	if host == dockerHub && !strings.Contains(path, "/") {
+		path = "library/" + path
+	}
+	return host, path
+}
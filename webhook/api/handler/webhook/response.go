@@ -4,10 +4,15 @@
 package webhook
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"reflect"
+	"sort"
+	"strings"
 
 	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -17,7 +22,81 @@ var (
 	ErrBadRequest     = errors.New("webhook: bad request")
 )
 
-const patchUpdateImage = `[{"op":"replace","path":"/spec/template/spec/containers/0/image", "value": "%s"}]`
+// PatchOperation is a JSON patch operation applied to the admitted object.
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// ReplaceImage returns the patch operation replacing the image at the container image path.
+func ReplaceImage(path, image string) PatchOperation {
+	return PatchOperation{Op: "replace", Path: path, Value: image}
+}
+
+// MapPatches returns the patch operations setting the entries of the string map at path;
+// e.g. /metadata/annotations, whose current entries are current. The whole map is added
+// when it has no entry, otherwise each entry is added or replaced, unless unchanged.
+func MapPatches(path string, current, entries map[string]string) []PatchOperation {
+	if len(entries) == 0 {
+		return nil
+	}
+	if len(current) == 0 {
+		return []PatchOperation{{Op: "add", Path: path, Value: entries}}
+	}
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var patch []PatchOperation
+	for _, key := range keys {
+		value, exists := current[key]
+		switch {
+		case !exists:
+			patch = append(patch, PatchOperation{Op: "add", Path: path + "/" + escapePointer(key), Value: entries[key]})
+		case value != entries[key]:
+			patch = append(patch, PatchOperation{Op: "replace", Path: path + "/" + escapePointer(key), Value: entries[key]})
+		}
+	}
+	return patch
+}
+
+// EnvPatches returns the patch operations setting the environment variables in the env list
+// at path; e.g. /spec/template/spec/containers/0/env, whose current variables are current.
+// The list is added when it has no variable, otherwise each variable is appended when missing,
+// and replaced, dropping any valueFrom it had, when it is set differently.
+func EnvPatches(path string, current []corev1.EnvVar, env ...corev1.EnvVar) []PatchOperation {
+	if len(env) == 0 {
+		return nil
+	}
+	if len(current) == 0 {
+		return []PatchOperation{{Op: "add", Path: path, Value: env}}
+	}
+	var patch []PatchOperation
+	for _, e := range env {
+		index := -1
+		for i, c := range current {
+			if c.Name == e.Name {
+				index = i
+				break
+			}
+		}
+		switch {
+		case index < 0:
+			patch = append(patch, PatchOperation{Op: "add", Path: path + "/-", Value: e})
+		case !reflect.DeepEqual(current[index], e):
+			patch = append(patch, PatchOperation{Op: "replace", Path: fmt.Sprintf("%s/%d", path, index), Value: e})
+		}
+	}
+	return patch
+}
+
+// escapePointer escapes a key to be a JSON pointer reference token; e.g. kubernetes.io~1change-cause.
+func escapePointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
 
 // BadRequestResponse is the response returned to the cluster when a bad request is sent.
 func BadRequestResponse(err error) (*v1.AdmissionReview, error) {
@@ -36,6 +115,9 @@ func BadRequestResponse(err error) (*v1.AdmissionReview, error) {
 // Response encapsulates the AdmissionResponse sent to API Gateway.
 type Response struct {
 	Admission *v1.AdmissionResponse
+
+	patch   []PatchOperation
+	failure error
 }
 
 // NewResponseFromRequest creates a Response from a Request.
@@ -61,6 +143,7 @@ func (r *Response) FailValidation(code int32, failure error) (*v1.AdmissionRevie
 	}
 
 	r.Admission.Allowed = false
+	r.failure = failure
 	r.Admission.Result = &metav1.Status{
 		Status:  metav1.StatusFailure,
 		Message: failure.Error(),
@@ -72,21 +155,81 @@ func (r *Response) FailValidation(code int32, failure error) (*v1.AdmissionRevie
 }
 
 // PassValidation populates the AdmissionResponse with the pass contents
-// (message) and returns the AdmissionReview JSON response for API Gateway.
-func (r *Response) PassValidation(image string) *v1.AdmissionReview {
+// (message and patch) and returns the AdmissionReview JSON response for API Gateway.
+func (r *Response) PassValidation(patch ...PatchOperation) (*v1.AdmissionReview, error) {
+	return r.PassValidationWithMessage("deployment contains compliant ecr repositories and images", patch...)
+}
+
+// PassValidationWithMessage is PassValidation for admissions of resources other than deployments.
+func (r *Response) PassValidationWithMessage(message string, patch ...PatchOperation) (*v1.AdmissionReview, error) {
 	r.Admission.Allowed = true
+	r.patch = patch
 	// Mutating the AdmissionReview
-	if len(image) != 0 {
+	if len(patch) != 0 {
+		patchBytes, err := encodePatch(patch)
+		if err != nil {
+			return nil, err
+		}
 		patchType := v1.PatchTypeJSONPatch
 		r.Admission.PatchType = &patchType
-		r.Admission.Patch = encodePatch(image)
+		r.Admission.Patch = patchBytes
 	}
 	r.Admission.Result = &metav1.Status{
 		Status:  metav1.StatusSuccess,
-		Message: "deployment contains compliant ecr repositories and images",
+		Message: message,
 		Code:    200,
 	}
-	return respond(r.Admission)
+	return respond(r.Admission), nil
+}
+
+// Patch returns the patch operations the response passed the validation with.
+func (r *Response) Patch() []PatchOperation {
+	return r.patch
+}
+
+// Failure returns the error the response failed the validation with.
+func (r *Response) Failure() error {
+	return r.failure
+}
+
+// Audit turns the response into the one of an audited admission: the admission is allowed
+// without its patch, and the patch or denial it would have had is reported in warnings
+// and audit annotations, which the API server records in its audit log; the values of
+// the environment variables the patch would set are redacted from them.
+func (r *Response) Audit() *v1.AdmissionReview {
+	a := r.Admission
+	r.Annotate("mode", "audit")
+	if !a.Allowed && a.Result != nil {
+		r.Annotate("violation", a.Result.Message)
+		r.Warn("audit: the deployment would be denied: %s", a.Result.Message)
+	}
+	if len(a.Patch) > 0 {
+		if patch, err := encodePatch(RedactPatch(r.patch)); err == nil {
+			r.Annotate("patch", string(patch))
+		}
+		r.Warn("audit: the deployment would be patched with %d operations, see the audit annotations", len(r.patch))
+	}
+
+	a.Allowed, a.Patch, a.PatchType = true, nil, nil
+	a.Result = &metav1.Status{
+		Status:  metav1.StatusSuccess,
+		Message: "deployment allowed unmodified in audit mode",
+		Code:    200,
+	}
+	return respond(a)
+}
+
+// Annotate adds an audit annotation, whose key the API server prefixes with the webhook's name.
+func (r *Response) Annotate(key, value string) {
+	if r.Admission.AuditAnnotations == nil {
+		r.Admission.AuditAnnotations = make(map[string]string)
+	}
+	r.Admission.AuditAnnotations[key] = value
+}
+
+// Warn adds a warning to the AdmissionResponse, which clients such as kubectl display.
+func (r *Response) Warn(format string, args ...interface{}) {
+	r.Admission.Warnings = append(r.Admission.Warnings, fmt.Sprintf(format, args...))
 }
 
 func respond(admission *v1.AdmissionResponse) *v1.AdmissionReview {
@@ -99,12 +242,6 @@ func respond(admission *v1.AdmissionResponse) *v1.AdmissionReview {
 	}
 }
 
-func encodePatch(image string) []byte {
-	fmt.Printf("final patch: %s", fmt.Sprintf(patchUpdateImage, image))
-	patchBytes := []byte(fmt.Sprintf(patchUpdateImage, image))
-
-	// Create a byte slice to store the base64-encoded result
-	// encodedBytes := make([]byte, base64.StdEncoding.EncodedLen(len(patchBytes)))
-	// base64.StdEncoding.Encode(encodedBytes, patchBytes)
-	return patchBytes
+func encodePatch(patch []PatchOperation) ([]byte, error) {
+	return json.Marshal(patch)
 }
@@ -0,0 +1,80 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package webhook
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestMapPatches(t *testing.T) {
+	entries := map[string]string{"kubernetes.io/change-cause": "set", "team": "a"}
+	tests := []struct {
+		name    string
+		current map[string]string
+		want    []PatchOperation
+	}{
+		{"NoEntry", nil, []PatchOperation{{Op: "add", Path: "/metadata/annotations", Value: entries}}},
+		{"AddAndReplace", map[string]string{"team": "b"}, []PatchOperation{
+			{Op: "add", Path: "/metadata/annotations/kubernetes.io~1change-cause", Value: "set"},
+			{Op: "replace", Path: "/metadata/annotations/team", Value: "a"},
+		}},
+		{"Unchanged", map[string]string{"kubernetes.io/change-cause": "set", "team": "a", "other": "x"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MapPatches("/metadata/annotations", tt.current, entries); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MapPatches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactPatch(t *testing.T) {
+	secret := &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "gmt"}, Key: "DB_PASSWORD"}}
+	patch := []PatchOperation{
+		ReplaceImage("/spec/template/spec/containers/0/image", "gmt-backend:5d1a9c2"),
+		{Op: "add", Path: "/spec/template/spec/containers/0/env", Value: []corev1.EnvVar{{Name: "LOG_LEVEL", Value: "info"}, {Name: "DB_PASSWORD", ValueFrom: secret}}},
+		{Op: "add", Path: "/spec/template/spec/containers/0/env/-", Value: corev1.EnvVar{Name: "API_KEY", Value: "s3cr3t"}},
+		{Op: "replace", Path: "/spec/template/spec/containers/0/env/2/value", Value: "s3cr3t"},
+	}
+	want := []PatchOperation{
+		ReplaceImage("/spec/template/spec/containers/0/image", "gmt-backend:5d1a9c2"),
+		{Op: "add", Path: "/spec/template/spec/containers/0/env", Value: []corev1.EnvVar{{Name: "LOG_LEVEL", Value: Redacted}, {Name: "DB_PASSWORD", ValueFrom: secret}}},
+		{Op: "add", Path: "/spec/template/spec/containers/0/env/-", Value: corev1.EnvVar{Name: "API_KEY", Value: Redacted}},
+		{Op: "replace", Path: "/spec/template/spec/containers/0/env/2/value", Value: Redacted},
+	}
+	if got := RedactPatch(patch); !reflect.DeepEqual(got, want) {
+		t.Errorf("RedactPatch() = %v, want %v", got, want)
+	}
+	if value := patch[2].Value.(corev1.EnvVar).Value; value != "s3cr3t" {
+		t.Errorf("RedactPatch() modified the patch, got %q", value)
+	}
+}
+
+func TestAuditRedactsPatch(t *testing.T) {
+	response, err := NewResponseFromRequest(&Request{Admission: &v1.AdmissionRequest{UID: "705ab4f5"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := response.PassValidation(
+		ReplaceImage("/spec/template/spec/containers/0/image", "gmt-backend:5d1a9c2"),
+		PatchOperation{Op: "add", Path: "/spec/template/spec/containers/0/env", Value: []corev1.EnvVar{{Name: "API_KEY", Value: "s3cr3t"}}},
+	); err != nil {
+		t.Fatal(err)
+	}
+	review := response.Audit()
+
+	annotation := review.Response.AuditAnnotations["patch"]
+	if strings.Contains(annotation, "s3cr3t") || !strings.Contains(annotation, "API_KEY") || !strings.Contains(annotation, Redacted) {
+		t.Errorf("Audit() annotated the patch %s, want its environment values redacted", annotation)
+	}
+	if review.Response.Patch != nil {
+		t.Errorf("Audit() patched the deployment with %s", review.Response.Patch)
+	}
+}
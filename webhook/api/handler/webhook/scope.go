@@ -0,0 +1,141 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package webhook
+
+import (
+	"errors"
+	"k8s-update-deployment-ecr-tag/webhook/api/config"
+	"path"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// ErrNoNamespaceLister is returned when a rule selects namespaces by label
+// but the labels of namespaces cannot be listed.
+var ErrNoNamespaceLister = errors.New("webhook: namespace selectors need access to the kubernetes api")
+
+// NamespaceLister provides the labels of namespaces.
+type NamespaceLister interface {
+	Labels(namespace string) (map[string]string, error)
+}
+
+// InScope checks that the policy mutates the deployment; that is the deployment
+// is in a mutated namespace and its labels match the policy's object selector.
+// The reason the deployment is out of scope is returned along with false.
+func InScope(deployment *appsv1.Deployment, policy config.Policy, namespaces NamespaceLister) (bool, string, error) {
+	scope := policy.Namespaces
+
+	if InCriticalNamespace(deployment, scope.Ignored) {
+		return false, "deployment is in critical namespace", nil
+	}
+
+	m := &namespaceMatcher{namespace: deployment.Namespace, lister: namespaces}
+	excluded, err := m.matchAny(scope.Exclude)
+	if err != nil {
+		return false, "", err
+	}
+	if excluded {
+		return false, "deployment namespace is excluded", nil
+	}
+
+	included := !NotInDeploymentNamespace(deployment, scope.Deployment)
+	if !included {
+		if included, err = m.matchAny(scope.Include); err != nil {
+			return false, "", err
+		}
+	}
+	if !included {
+		return false, "deployment is not in the deployment namespaces", nil
+	}
+
+	if policy.ObjectSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(policy.ObjectSelector)
+		if err != nil {
+			return false, "", err
+		}
+		if !selector.Matches(labels.Set(deployment.Labels)) {
+			return false, "deployment labels do not match the object selector", nil
+		}
+	}
+	return true, "", nil
+}
+
+// ProfileFor returns the profile of the first environment matching the
+// deployment's namespace, or the default profile when none does.
+func ProfileFor(deployment *appsv1.Deployment, policy config.Policy, namespaces NamespaceLister) (config.Profile, error) {
+	m := &namespaceMatcher{namespace: deployment.Namespace, lister: namespaces}
+	for i := range policy.Environments {
+		env := &policy.Environments[i]
+		matched, err := m.matchAny(env.Namespaces)
+		if err != nil {
+			return config.Profile{}, err
+		}
+		if matched {
+			return policy.Profile(env), nil
+		}
+	}
+	return policy.Profile(nil), nil
+}
+
+// namespaceMatcher matches a namespace against rules, looking
+// its labels up once, and only when a rule needs them.
+type namespaceMatcher struct {
+	namespace string
+	lister    NamespaceLister
+
+	labels labels.Set
+	looked bool
+}
+
+func (m *namespaceMatcher) namespaceLabels() (labels.Set, error) {
+	if m.looked {
+		return m.labels, nil
+	}
+	if m.lister == nil {
+		return nil, ErrNoNamespaceLister
+	}
+	l, err := m.lister.Labels(m.namespace)
+	if err != nil {
+		return nil, err
+	}
+	m.labels, m.looked = labels.Set(l), true
+	return m.labels, nil
+}
+
+// matchAny checks that one of the rules matches the namespace.
+func (m *namespaceMatcher) matchAny(rules []config.NamespaceRule) (bool, error) {
+	for _, rule := range rules {
+		matched, err := m.match(rule)
+		if err != nil || matched {
+			return matched, err
+		}
+	}
+	return false, nil
+}
+
+// match checks that every field set on the rule matches the namespace.
+func (m *namespaceMatcher) match(rule config.NamespaceRule) (bool, error) {
+	if rule.Name != "" && rule.Name != m.namespace {
+		return false, nil
+	}
+	if rule.Pattern != "" {
+		if matched, err := path.Match(rule.Pattern, m.namespace); err != nil || !matched {
+			return false, err
+		}
+	}
+	if rule.HasSelector() {
+		selector, err := metav1.LabelSelectorAsSelector(rule.Selector)
+		if err != nil {
+			return false, err
+		}
+		nsLabels, err := m.namespaceLabels()
+		if err != nil {
+			return false, err
+		}
+		return selector.Matches(nsLabels), nil
+	}
+	return true, nil
+}
@@ -0,0 +1,85 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package webhook
+
+import (
+	"k8s-update-deployment-ecr-tag/webhook/api/config"
+	"k8s-update-deployment-ecr-tag/webhook/api/testdata"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakeNamespaces map[string]map[string]string
+
+func (f fakeNamespaces) Labels(namespace string) (map[string]string, error) {
+	return f[namespace], nil
+}
+
+func TestInScope(t *testing.T) {
+	namespaces := fakeNamespaces{
+		"develop":    {"environment": "develop"},
+		"staging":    {"environment": "staging"},
+		"prod":       {"environment": "prod", "frozen": "true"},
+		"team-a":     {},
+		"ml-sandbox": {"environment": "sandbox"},
+	}
+	policy := config.DefaultPolicy()
+	policy.Namespaces.Deployment = "develop"
+	policy.Namespaces.Include = []config.NamespaceRule{
+		{Pattern: "team-*"},
+		{Selector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: "environment", Operator: metav1.LabelSelectorOpIn, Values: []string{"staging", "prod"}},
+		}}},
+	}
+	policy.Namespaces.Exclude = []config.NamespaceRule{
+		{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"frozen": "true"}}},
+	}
+
+	objectPolicy := policy
+	objectPolicy.ObjectSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"ecr-tag": "managed"}}
+
+	tests := []struct {
+		name      string
+		namespace string
+		labels    map[string]string
+		policy    config.Policy
+		want      bool
+	}{
+		{"Critical", "kube-system", nil, policy, false},
+		{"DeploymentNamespace", "develop", nil, policy, true},
+		{"Pattern", "team-a", nil, policy, true},
+		{"Selector", "staging", nil, policy, true},
+		{"Excluded", "prod", nil, policy, false},
+		{"NotIncluded", "ml-sandbox", nil, policy, false},
+		{"ObjectSelectorMatches", "develop", map[string]string{"ecr-tag": "managed"}, objectPolicy, true},
+		{"ObjectSelectorDoesNotMatch", "develop", map[string]string{"app": "echo"}, objectPolicy, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deployment := newDeploymentWithImage(testdata.TaggedImage)
+			deployment.Namespace = tt.namespace
+			deployment.Labels = tt.labels
+			got, reason, err := InScope(deployment, tt.policy, namespaces)
+			if err != nil {
+				t.Fatalf("InScope() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("InScope() = %v (%s), want %v", got, reason, tt.want)
+			}
+		})
+	}
+}
+
+func TestInScopeWithoutNamespaceLister(t *testing.T) {
+	policy := config.DefaultPolicy()
+	policy.Namespaces.Include = []config.NamespaceRule{
+		{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"environment": "staging"}}},
+	}
+	deployment := newDeploymentWithImage(testdata.TaggedImage)
+	deployment.Namespace = "staging"
+	if _, _, err := InScope(deployment, policy, nil); err != ErrNoNamespaceLister {
+		t.Errorf("InScope() error = %v, want %v", err, ErrNoNamespaceLister)
+	}
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"k8s-update-deployment-ecr-tag/webhook/api/handler"
+	"net/http"
+	"time"
+)
+
+// readinessTimeout bounds the checks of a readiness probe.
+const readinessTimeout = 2 * time.Second
+
+// check is a readiness check, returning why the webhook is not ready.
+type check struct {
+	name string
+	run  func(context.Context) error
+}
+
+// HandleHealthy responds that the webhook is alive, as long as it serves requests.
+func (app *App) HandleHealthy(w http.ResponseWriter, r *http.Request) {
+	jsonOk(w, map[string]string{"status": "ok"})
+}
+
+// HandleReady responds whether the webhook is ready to serve admissions, along
+// with the result of each check: the TLS certificate is loaded and valid, the policy
+// file was reloaded, the AWS credentials can be retrieved and the cache is warm.
+func (app *App) HandleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	status, code := "ready", http.StatusOK
+	results := make(map[string]string)
+	for _, c := range app.checks() {
+		results[c.name] = "ok"
+		if err := c.run(ctx); err != nil {
+			results[c.name] = err.Error()
+			status, code = "not ready", http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	writeJSON(w, map[string]interface{}{"status": status, "checks": results})
+}
+
+// checks returns the readiness checks of the webhook.
+func (app *App) checks() []check {
+	checks := []check{
+		{name: "certificate", run: func(context.Context) error { return certificateValid(app.Certificate, time.Now()) }},
+		{name: "policy", run: func(context.Context) error { return app.Policies.Err() }},
+	}
+	if app.Credentials != nil {
+		checks = append(checks, check{name: "awsCredentials", run: app.Credentials})
+	}
+	if app.Ready != nil {
+		checks = append(checks, check{name: "cache", run: func(context.Context) error { return app.Ready() }})
+	}
+	return checks
+}
+
+// certificateValid checks that the certificate is loaded and valid at the time.
+func certificateValid(cert *x509.Certificate, now time.Time) error {
+	if cert == nil {
+		return errors.New("not loaded")
+	}
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("not valid before %s", cert.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("expired on %s", cert.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// loadCertificate loads the TLS certificate and key, along with the leaf of the certificate.
+func loadCertificate(certFile, keyFile string) (tls.Certificate, *x509.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("loading the TLS certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("parsing the TLS certificate: %w", err)
+	}
+	return cert, leaf, nil
+}
+
+// HandleVersion responds the version of the webhook, injected when building it.
+func (app *App) HandleVersion(w http.ResponseWriter, r *http.Request) {
+	version := handler.Version
+	if version == "" {
+		version = "dev"
+	}
+	jsonOk(w, map[string]string{"version": version})
+}
@@ -0,0 +1,168 @@
+// Package metrics contains the Prometheus metrics of the webhook.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "ecr_tag"
+
+// Decisions an audited admission would have had.
+const (
+	AuditPatch     = "patch"
+	AuditDeny      = "deny"
+	AuditUnchanged = "unchanged"
+)
+
+// Outcomes of admissions.
+const (
+	OutcomeAllowed = "allowed"
+	OutcomePatched = "patched"
+	OutcomeDenied  = "denied"
+	OutcomeAudited = "audited"
+)
+
+// Results of cache lookups.
+const (
+	CacheHit       = "hit"
+	CacheMiss      = "miss"
+	CacheCoalesced = "coalesced"
+)
+
+var (
+	admissions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "admissions_total",
+		Help:      "Admissions reviewed, by namespace, kind, operation and outcome: allowed, patched, denied or audited.",
+	}, []string{"namespace", "kind", "operation", "outcome"})
+	denials = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "denials_total",
+		Help:      "Admissions denied, by reason; the error class of failures to check or resolve images.",
+	}, []string{"reason"})
+	patchOperations = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "patch_operations_total",
+		Help:      "Patch operations applied to admitted deployments.",
+	})
+	tagResolutions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tag_resolutions_total",
+		Help:      "Tags resolved for images, by tag source; lastKnownTag when served on failure.",
+	}, []string{"source"})
+	admissionDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "admission_duration_seconds",
+		Help:      "Time taken to review an admission.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	})
+	awsRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "aws_request_duration_seconds",
+		Help:      "Time taken by AWS API calls, retries included, by service, operation and whether they failed.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"service", "operation", "failed"})
+	auditDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "audit_decisions_total",
+		Help:      "Admissions allowed in audit mode, by the decision they would have had.",
+	}, []string{"decision"})
+	auditPatchOperations = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "audit_patch_operations_total",
+		Help:      "Patch operations not applied to admissions in audit mode.",
+	})
+	cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_requests_total",
+		Help:      "Lookups of the AWS caches, by cache and result: hit, miss or coalesced with a concurrent miss.",
+	}, []string{"cache", "result"})
+	breakerOpen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "circuit_breaker_open",
+		Help:      "Whether the circuit breaker of an AWS service in a region and account is open, failing its calls fast.",
+	}, []string{"service", "region", "account"})
+)
+
+func init() {
+	prometheus.MustRegister(admissions, denials, patchOperations, tagResolutions, admissionDuration, awsRequestDuration,
+		auditDecisions, auditPatchOperations, cacheRequests, breakerOpen)
+}
+
+// Admission describes a reviewed admission in the metrics.
+type Admission struct {
+	Namespace string
+	Kind      string
+	Operation string
+	Outcome   string
+	// Reason is why the admission was denied.
+	Reason string
+	// PatchOperations is the number of operations applied to the admitted resource.
+	PatchOperations int
+	Duration        time.Duration
+}
+
+// ObserveAdmission counts a reviewed admission and the time taken to review it.
+func ObserveAdmission(a Admission) {
+	admissions.WithLabelValues(a.Namespace, a.Kind, a.Operation, a.Outcome).Inc()
+	if a.Outcome == OutcomeDenied {
+		denials.WithLabelValues(a.Reason).Inc()
+	}
+	patchOperations.Add(float64(a.PatchOperations))
+	admissionDuration.Observe(a.Duration.Seconds())
+}
+
+// ObserveTagResolution counts a tag resolved from the source.
+func ObserveTagResolution(source string) {
+	tagResolutions.WithLabelValues(source).Inc()
+}
+
+// InstrumentAWS observes the latency of the requests sent with the handlers,
+// typically those of a session.
+func InstrumentAWS(handlers *request.Handlers) {
+	handlers.Complete.PushBackNamed(request.NamedHandler{Name: "metrics.ObserveAWS", Fn: func(r *request.Request) {
+		failed := "false"
+		if r.Error != nil {
+			failed = "true"
+		}
+		awsRequestDuration.WithLabelValues(r.ClientInfo.ServiceName, r.Operation.Name, failed).Observe(time.Since(r.Time).Seconds())
+	}})
+}
+
+// ObserveAudit counts an audited admission from the response it would have had.
+func ObserveAudit(allowed bool, patchOperations int) {
+	decision := AuditUnchanged
+	switch {
+	case !allowed:
+		decision = AuditDeny
+	case patchOperations > 0:
+		decision = AuditPatch
+	}
+	auditDecisions.WithLabelValues(decision).Inc()
+	auditPatchOperations.Add(float64(patchOperations))
+}
+
+// ObserveCache counts a lookup of the cache with its result.
+func ObserveCache(cache, result string) {
+	cacheRequests.WithLabelValues(cache, result).Inc()
+}
+
+// SetBreakerOpen records whether the circuit breaker of the service is open, in the
+// region and account; the account is empty for the webhook's own.
+func SetBreakerOpen(service, region, account string, open bool) {
+	value := 0.0
+	if open {
+		value = 1
+	}
+	breakerOpen.WithLabelValues(service, region, account).Set(value)
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
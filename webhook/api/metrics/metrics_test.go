@@ -0,0 +1,25 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObserveAudit(t *testing.T) {
+	before := testutil.ToFloat64(auditDecisions.WithLabelValues(AuditPatch))
+	ObserveAudit(true, 2)
+	ObserveAudit(false, 0)
+	require.Equal(t, before+1, testutil.ToFloat64(auditDecisions.WithLabelValues(AuditPatch)))
+	require.Equal(t, float64(1), testutil.ToFloat64(auditDecisions.WithLabelValues(AuditDeny)))
+	require.Equal(t, float64(2), testutil.ToFloat64(auditPatchOperations))
+}
+
+func TestObserveAdmission(t *testing.T) {
+	ObserveAdmission(Admission{Namespace: "develop", Kind: "Deployment", Operation: "CREATE", Outcome: OutcomePatched, PatchOperations: 3})
+	ObserveAdmission(Admission{Namespace: "develop", Kind: "Deployment", Operation: "UPDATE", Outcome: OutcomeDenied, Reason: "parameterMissing"})
+	require.Equal(t, float64(1), testutil.ToFloat64(admissions.WithLabelValues("develop", "Deployment", "CREATE", OutcomePatched)))
+	require.Equal(t, float64(1), testutil.ToFloat64(denials.WithLabelValues("parameterMissing")))
+	require.Equal(t, float64(3), testutil.ToFloat64(patchOperations))
+}
@@ -1,6 +1,9 @@
 package api
 
 import (
+	"k8s-update-deployment-ecr-tag/webhook/api/metrics"
+	"k8s-update-deployment-ecr-tag/webhook/api/tracing"
+
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 )
@@ -10,11 +13,30 @@ func BuildRouter(app *App) *chi.Mux {
 	r := chi.NewRouter()
 
 	r.Use(middleware.RequestID)
+	r.Use(tracing.Middleware)
 	r.Use(middleware.RealIP)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 
 	r.Post("/", app.HandleMutate)
+	r.Post("/validate-tagpolicy", app.HandleValidateTagPolicy)
+	r.Get("/policy", app.HandlePolicy)
+	r.With(app.Authenticate).Get("/audit", app.HandleAudit)
+
+	return r
+}
+
+// BuildAdminRouter builds the router of the admin listener, kept apart from the
+// admissions so that it is scraped and probed without their TLS certificate.
+func BuildAdminRouter(app *App) *chi.Mux {
+	r := chi.NewRouter()
+
+	r.Use(middleware.Recoverer)
+
+	r.Handle("/metrics", metrics.Handler())
+	r.Get("/healthz", app.HandleHealthy)
+	r.Get("/readyz", app.HandleReady)
+	r.Get("/version", app.HandleVersion)
 
 	return r
 }
@@ -1,23 +1,90 @@
 package api
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"k8s-update-deployment-ecr-tag/webhook/api/config"
+	"k8s-update-deployment-ecr-tag/webhook/api/handler"
+	"k8s-update-deployment-ecr-tag/webhook/api/tracing"
 	"net/http"
-	"os"
+
+	log "github.com/sirupsen/logrus"
 )
 
 // StartServer starts the server
-func StartServer() error {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8000"
+func StartServer(cfg *config.Config) error {
+	configureLogging(cfg.Log)
+
+	shutdown, err := tracing.Setup(context.Background(), cfg.Tracing)
+	if err != nil {
+		return err
 	}
+	defer shutdown(context.Background())
 
-	app := &App{}
+	policies, err := policySource(cfg)
+	if err != nil {
+		return err
+	}
+
+	webhook, err := handler.New(context.Background(), cfg, policies)
+	if err != nil {
+		return err
+	}
+
+	cert, leaf, err := loadCertificate(cfg.Server.TLSCert, cfg.Server.TLSKey)
+	if err != nil {
+		return err
+	}
+
+	app := NewApp(cfg, policies, webhook.Handler)
+	app.Certificate = leaf
+	app.Credentials = webhook.Credentials
+	app.Ready = webhook.Ready
+	app.Audit = webhook.Audit
 
 	mux := BuildRouter(app)
 
-	fmt.Printf("Listening on port %s\n", port)
+	go func() {
+		log.Infof("Serving the admin endpoints on port %d", cfg.Server.AdminPort)
+		if err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.Server.AdminPort), BuildAdminRouter(app)); err != nil {
+			log.Errorf("Error serving the admin endpoints: %v", err)
+		}
+	}()
+
+	fmt.Printf("Listening on port %d\n", cfg.Server.Port)
 
-	return http.ListenAndServeTLS(fmt.Sprintf(":%s", port), "/tls/tls.crt", "/tls/tls.key", mux)
+	server := &http.Server{
+		Addr:      fmt.Sprintf(":%d", cfg.Server.Port),
+		Handler:   mux,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+	return server.ListenAndServeTLS("", "")
+}
+
+// policySource returns the policy of the configuration, or a watcher
+// reloading the policy file when one is configured.
+func policySource(cfg *config.Config) (config.PolicySource, error) {
+	if cfg.PolicyFile == "" {
+		return config.NewStaticPolicy(cfg.Policy), nil
+	}
+	watcher, err := config.NewPolicyWatcher(cfg.PolicyFile, cfg.PolicyReloadInterval.Duration)
+	if err != nil {
+		return nil, err
+	}
+	go watcher.Run(context.Background())
+	return watcher, nil
+}
+
+// configureLogging sets up the logger; the level was validated with the configuration.
+func configureLogging(cfg config.Log) {
+	level, _ := log.ParseLevel(cfg.Level)
+	if cfg.Format == config.LogFormatText {
+		log.SetFormatter(new(log.TextFormatter))
+	} else {
+		log.SetFormatter(new(log.JSONFormatter))
+	}
+	log.AddHook(tracing.LogHook{})
+	log.Infof("Got log level [%s]", level)
+	log.SetLevel(level)
 }
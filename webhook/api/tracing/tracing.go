@@ -0,0 +1,151 @@
+// Package tracing traces the admissions and the AWS calls they make with OpenTelemetry,
+// exporting the spans over OTLP and adding their trace IDs to the log lines.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"k8s-update-deployment-ecr-tag/webhook/api/config"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ServiceName identifies the webhook in the traces.
+const ServiceName = "k8s-update-deployment-ecr-tag"
+
+// Attributes of the admission spans.
+const (
+	AdmissionUID = attribute.Key("admission.uid")
+	Namespace    = attribute.Key("k8s.namespace.name")
+	Deployment   = attribute.Key("k8s.deployment.name")
+	Repository   = attribute.Key("ecr.repository")
+	Parameter    = attribute.Key("ssm.parameter")
+)
+
+// Setup exports the traces to the configured OTLP collector and returns the function
+// flushing them on shutdown. Tracing is left disabled when no endpoint is configured.
+func Setup(ctx context.Context, cfg config.Tracing) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	if cfg.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("tracing: creating the otlp exporter: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(ServiceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	log.Infof("Exporting traces to %s", cfg.Endpoint)
+	return provider.Shutdown, nil
+}
+
+// Start starts a span of the webhook, the child of the span of the context if any.
+func Start(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(ServiceName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// Fail records the error on the span.
+func Fail(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// End ends the span, recording the error it returns when deferred by a function.
+func End(span trace.Span, err *error) {
+	if *err != nil {
+		Fail(span, *err)
+	}
+	span.End()
+}
+
+// Middleware traces the requests served by a chi router, continuing
+// the trace of the caller when it propagated one.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := otel.Tracer(ServiceName).Start(ctx, r.Method+" "+r.URL.Path,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPMethodKey.String(r.Method), semconv.HTTPTargetKey.String(r.URL.Path)))
+		defer span.End()
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		if rctx := chi.RouteContext(ctx); rctx != nil && rctx.RoutePattern() != "" {
+			span.SetName(r.Method + " " + rctx.RoutePattern())
+			span.SetAttributes(semconv.HTTPRouteKey.String(rctx.RoutePattern()))
+		}
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(ww.Status()))
+		if ww.Status() >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(ww.Status()))
+		}
+	})
+}
+
+// InstrumentAWS traces the requests sent with the handlers, typically those of a session,
+// as children of the span of their context. The span covers the retries of the request.
+func InstrumentAWS(handlers *request.Handlers) {
+	handlers.Validate.PushFrontNamed(request.NamedHandler{Name: "tracing.Start", Fn: func(r *request.Request) {
+		ctx, _ := otel.Tracer(ServiceName).Start(r.Context(), r.ClientInfo.ServiceName+"."+r.Operation.Name,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				semconv.RPCSystemKey.String("aws-api"),
+				semconv.RPCServiceKey.String(r.ClientInfo.ServiceName),
+				semconv.RPCMethodKey.String(r.Operation.Name),
+			))
+		r.SetContext(ctx)
+	}})
+	handlers.Complete.PushBackNamed(request.NamedHandler{Name: "tracing.End", Fn: func(r *request.Request) {
+		span := trace.SpanFromContext(r.Context())
+		span.SetAttributes(attribute.Int("aws.retries", r.RetryCount))
+		if r.HTTPResponse != nil {
+			span.SetAttributes(semconv.HTTPStatusCodeKey.Int(r.HTTPResponse.StatusCode))
+		}
+		if r.Error != nil {
+			Fail(span, r.Error)
+		}
+		span.End()
+	}})
+}
+
+// LogHook adds the IDs of the span of the entry's context to the log lines,
+// for the entries logged with WithContext.
+type LogHook struct{}
+
+// Levels returns the levels the hook fires for, all of them.
+func (LogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire adds the trace and span IDs to the entry.
+func (LogHook) Fire(entry *log.Entry) error {
+	if entry.Context == nil {
+		return nil
+	}
+	if sc := trace.SpanContextFromContext(entry.Context); sc.IsValid() {
+		entry.Data["trace_id"] = sc.TraceID().String()
+		entry.Data["span_id"] = sc.SpanID().String()
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/go-chi/chi"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+)
+
+// record sets up a tracer provider exporting the spans in memory.
+func record(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+	return exporter
+}
+
+func TestMiddleware(t *testing.T) {
+	exporter := record(t)
+	r := chi.NewRouter()
+	r.Use(Middleware)
+	r.Get("/policy/{name}", func(w http.ResponseWriter, r *http.Request) {
+		_, span := Start(r.Context(), "render", Namespace.String("develop"))
+		span.End()
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/policy/default", nil))
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 2)
+	child, server := spans[0], spans[1]
+	require.Equal(t, "render", child.Name)
+	require.Equal(t, server.SpanContext.SpanID(), child.Parent.SpanID())
+	require.Contains(t, child.Attributes, Namespace.String("develop"))
+	require.Equal(t, "GET /policy/{name}", server.Name)
+	require.Contains(t, server.Attributes, semconv.HTTPStatusCodeKey.Int(http.StatusInternalServerError))
+	require.Equal(t, codes.Error, server.Status.Code)
+}
+
+func TestInstrumentAWS(t *testing.T) {
+	exporter := record(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"ParameterNotFound","message":"not found"}`))
+	}))
+	defer server.Close()
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:    aws.String(server.URL),
+		Region:      aws.String("eu-west-3"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	}))
+	InstrumentAWS(&sess.Handlers)
+
+	ctx, span := Start(context.Background(), "tag resolution")
+	_, err := ssm.New(sess).GetParameterWithContext(ctx, &ssm.GetParameterInput{Name: aws.String("/gmt/backend/ecr_tag")})
+	span.End()
+	require.Error(t, err)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 2)
+	call := spans[0]
+	require.Equal(t, "ssm.GetParameter", call.Name)
+	require.Equal(t, span.SpanContext().SpanID(), call.Parent.SpanID())
+	require.Contains(t, call.Attributes, semconv.HTTPStatusCodeKey.Int(http.StatusBadRequest))
+	require.Contains(t, call.Attributes, attribute.Int("aws.retries", 0))
+	require.Equal(t, codes.Error, call.Status.Code)
+}
+
+func TestLogHook(t *testing.T) {
+	record(t)
+	var out bytes.Buffer
+	logger := log.New()
+	logger.Out = &out
+	logger.Formatter = new(log.JSONFormatter)
+	logger.AddHook(LogHook{})
+
+	ctx, span := Start(context.Background(), "admission")
+	defer span.End()
+	logger.WithContext(ctx).Info("traced")
+	logger.Info("untraced")
+
+	lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	require.Len(t, lines, 2)
+	require.Contains(t, string(lines[0]), `"trace_id":"`+span.SpanContext().TraceID().String()+`"`)
+	require.NotContains(t, string(lines[1]), "trace_id")
+}
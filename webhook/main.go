@@ -2,11 +2,17 @@ package main
 
 import (
 	"k8s-update-deployment-ecr-tag/webhook/api"
+	"k8s-update-deployment-ecr-tag/webhook/api/config"
 	"log"
+	"os"
 )
 
 func main() {
-	err := api.StartServer()
+	cfg, err := config.Load(os.Args[1:], os.LookupEnv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = api.StartServer(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
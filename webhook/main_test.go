@@ -4,22 +4,34 @@
 package main
 
 import (
+	"context"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"k8s-update-deployment-ecr-tag/webhook/api"
+	"k8s-update-deployment-ecr-tag/webhook/api/audit"
+	"k8s-update-deployment-ecr-tag/webhook/api/config"
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/function"
+	"k8s-update-deployment-ecr-tag/webhook/api/handler/webhook"
 	"k8s-update-deployment-ecr-tag/webhook/api/testdata"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -32,6 +44,11 @@ type mockECRClient struct {
 	ecriface.ECRAPI
 }
 
+// ECRFor serves every registry with the mock.
+func (_m *mockECRClient) ECRFor(registry webhook.Registry) ecriface.ECRAPI {
+	return _m
+}
+
 // DescribeRepositoriesWithContext mocks the DescribeRepositories ECR API endpoint.
 func (_m *mockECRClient) DescribeRepositoriesWithContext(ctx aws.Context, input *ecr.DescribeRepositoriesInput, opts ...request.Option) (*ecr.DescribeRepositoriesOutput, error) {
 	log.Infof("Mocking DescribeRepositories API with input: %s\n", input.String())
@@ -46,16 +63,40 @@ func (_m *mockECRClient) DescribeImageScanFindingsPagesWithContext(ctx aws.Conte
 	return args.Error(0)
 }
 
+type mockSSMClient struct {
+	mock.Mock
+	ssmiface.SSMAPI
+}
+
+// GetParameterWithContext mocks the GetParameter SSM API endpoint.
+func (_m *mockSSMClient) GetParameterWithContext(ctx aws.Context, input *ssm.GetParameterInput, opts ...request.Option) (*ssm.GetParameterOutput, error) {
+	log.Infof("Mocking GetParameter API with input: %s\n", input.String())
+	args := _m.Called(ctx, input)
+	return args.Get(0).(*ssm.GetParameterOutput), args.Error(1)
+}
+
 var s *httptest.Server
 var patchType = v1.PatchTypeJSONPatch
 
+const (
+	deploymentNamespace = "develop"
+	stagingNamespace    = "staging"
+	registryID          = "123456789012"
+)
+
+var resolvedAt = time.Date(2020, 3, 7, 5, 30, 0, 0, time.UTC)
+
 func TestHandler(t *testing.T) {
 
 	type args struct {
 		image           string
 		repo            *ecr.Repository
+		repoNotFound    bool
+		repoErr         error
 		shouldCheckVuln bool
 		scanFindings    *ecr.DescribeImageScanFindingsOutput
+		parameterName   string
+		parameter       *ssm.Parameter
 		event           http.Request
 	}
 
@@ -64,9 +105,35 @@ func TestHandler(t *testing.T) {
 		value     []byte
 	}
 
-	ecrSvc := new(mockECRClient)
+	const (
+		previewNamespace = "preview"
+		auditNamespace   = "audit"
+	)
 
-	app := &api.App{}
+	cfg := config.Default()
+	cfg.AWS.Region = "eu-west-3"
+	cfg.Namespaces.Deployment = deploymentNamespace
+	cfg.Namespaces.Include = []config.NamespaceRule{{Name: stagingNamespace}, {Name: previewNamespace}, {Name: auditNamespace}}
+	cfg.Environments = []config.Environment{
+		{
+			Name:       stagingNamespace,
+			Namespaces: []config.NamespaceRule{{Name: stagingNamespace}},
+			Overrides:  config.Overrides{ParameterPrefix: "/{project}/{type}/{environment}"},
+		},
+		{
+			Name:       previewNamespace,
+			Namespaces: []config.NamespaceRule{{Name: previewNamespace}},
+			Overrides:  config.Overrides{OnFailure: config.OnFailure{AWSUnavailable: config.ActionAllow}},
+		},
+		{
+			Name:       auditNamespace,
+			Namespaces: []config.NamespaceRule{{Name: auditNamespace}},
+			Overrides:  config.Overrides{Mode: config.ModeAudit},
+		},
+	}
+	require.NoError(t, cfg.Validate())
+
+	app := api.NewApp(cfg, config.NewStaticPolicy(cfg.Policy), nil)
 
 	r := api.BuildRouter(app)
 	s = httptest.NewServer(r)
@@ -83,7 +150,12 @@ func TestHandler(t *testing.T) {
 		args    args
 		status  string
 		wantErr bool
-		patch   patch
+		// code is the status code of the denial, when not a client error.
+		code        int32
+		patch       patch
+		warnings    []string
+		annotations map[string]string
+		audited     bool
 	}{
 		{
 			name: "BadRequestFailure",
@@ -111,6 +183,7 @@ func TestHandler(t *testing.T) {
 				image:           "auth:notlatest",
 				shouldCheckVuln: false,
 				repo:            nil,
+				repoNotFound:    true,
 				event:           eventWithImage(req, "123456789012.dkr.ecr.region.amazonaws.com/auth:notlatest"),
 			},
 			status:  metav1.StatusFailure,
@@ -137,7 +210,8 @@ func TestHandler(t *testing.T) {
 					ImageTagMutability:         aws.String(ecr.ImageTagMutabilityMutable),
 					ImageScanningConfiguration: &ecr.ImageScanningConfiguration{ScanOnPush: aws.Bool(false)},
 				},
-				event: eventWithImage(req, "123456789012.dkr.ecr.region.amazonaws.com/test-frontend:notlatest"),
+				parameterName: "/test/frontend/ecr_tag",
+				event:         eventWithImage(req, "123456789012.dkr.ecr.region.amazonaws.com/test-frontend:notlatest"),
 			},
 			status:  metav1.StatusFailure,
 			wantErr: true,
@@ -152,30 +226,170 @@ func TestHandler(t *testing.T) {
 					ImageTagMutability:         aws.String(ecr.ImageTagMutabilityMutable),
 					ImageScanningConfiguration: &ecr.ImageScanningConfiguration{ScanOnPush: aws.Bool(false)},
 				},
-				event: eventWithImage(req, "123456789012.dkr.ecr.region.amazonaws.com/test2-frontend:notlatest"),
+				parameterName: "/test2/frontend/ecr_tag",
+				parameter:     &ssm.Parameter{Name: aws.String("/test2/frontend/ecr_tag"), Value: aws.String("bec0e8f"), Version: aws.Int64(3)},
+				event:         eventWithImage(req, "123456789012.dkr.ecr.region.amazonaws.com/test2-frontend:notlatest"),
+			},
+			warnings: []string{"container echo: replaced tag notlatest with bec0e8f, from /test2/frontend/ecr_tag (version 3)"},
+			annotations: map[string]string{
+				"image":             "123456789012.dkr.ecr.region.amazonaws.com/test2-frontend:bec0e8f",
+				"tag-source":        "ssm",
+				"parameter":         "/test2/frontend/ecr_tag",
+				"parameter-version": "3",
+				"checks":            "repositoryExists=passed,tagImmutability=skipped,scanOnPush=skipped,criticalVulnerabilities=skipped",
+			},
+			patch: patch{
+				patchType: &patchType,
+				value: []byte(`[
+					{"op": "replace", "path": "/spec/template/spec/containers/0/image", "value": "123456789012.dkr.ecr.region.amazonaws.com/test2-frontend:bec0e8f"},
+					{"op": "add", "path": "/metadata/annotations/ecr-tag.brilliantsolutions.com~1original-image", "value": "123456789012.dkr.ecr.region.amazonaws.com/test2-frontend:notlatest"},
+					{"op": "add", "path": "/metadata/annotations/ecr-tag.brilliantsolutions.com~1parameter-version", "value": "3"},
+					{"op": "add", "path": "/metadata/annotations/ecr-tag.brilliantsolutions.com~1resolved-at", "value": "2020-03-07T05:30:00Z"},
+					{"op": "add", "path": "/metadata/annotations/ecr-tag.brilliantsolutions.com~1resolved-image", "value": "123456789012.dkr.ecr.region.amazonaws.com/test2-frontend:bec0e8f"},
+					{"op": "add", "path": "/metadata/annotations/ecr-tag.brilliantsolutions.com~1tag-source", "value": "ssm"},
+					{"op": "add", "path": "/metadata/annotations/ecr-tag.brilliantsolutions.com~1tag-source-key", "value": "/test2/frontend/ecr_tag"},
+					{"op": "add", "path": "/metadata/annotations/kubernetes.io~1change-cause", "value": "ecr-tag: set image 123456789012.dkr.ecr.region.amazonaws.com/test2-frontend:bec0e8f from /test2/frontend/ecr_tag (version 3)"},
+					{"op": "add", "path": "/spec/template/metadata/annotations", "value": {
+						"ecr-tag.brilliantsolutions.com/original-image": "123456789012.dkr.ecr.region.amazonaws.com/test2-frontend:notlatest",
+						"ecr-tag.brilliantsolutions.com/parameter-version": "3",
+						"ecr-tag.brilliantsolutions.com/resolved-at": "2020-03-07T05:30:00Z",
+						"ecr-tag.brilliantsolutions.com/resolved-image": "123456789012.dkr.ecr.region.amazonaws.com/test2-frontend:bec0e8f",
+						"ecr-tag.brilliantsolutions.com/tag-source": "ssm",
+						"ecr-tag.brilliantsolutions.com/tag-source-key": "/test2/frontend/ecr_tag"
+					}}
+				]`),
+			},
+			status:  metav1.StatusSuccess,
+			wantErr: false,
+		},
+		{
+			name: "EnvironmentProfileParameterPrefix",
+			args: args{
+				image:           "test2-frontend",
+				shouldCheckVuln: false,
+				repo: &ecr.Repository{
+					RepositoryName:             aws.String("test2-frontend"),
+					ImageTagMutability:         aws.String(ecr.ImageTagMutabilityMutable),
+					ImageScanningConfiguration: &ecr.ImageScanningConfiguration{ScanOnPush: aws.Bool(false)},
+				},
+				parameterName: "/test2/frontend/staging/ecr_tag",
+				parameter:     &ssm.Parameter{Name: aws.String("/test2/frontend/staging/ecr_tag"), Value: aws.String("5d1a9c2")},
+				event:         eventWithImageInNamespace(req, stagingNamespace, "123456789012.dkr.ecr.region.amazonaws.com/test2-frontend:notlatest"),
 			},
+			warnings: []string{"container echo: replaced tag notlatest with 5d1a9c2, from /test2/frontend/staging/ecr_tag"},
 			patch: patch{
 				patchType: &patchType,
-				// base64 encoded : '[{"op":"replace","path":"/spec/containers/0/image", "value": "123456789012.dkr.ecr.region.amazonaws.com/test2-frontend:bec0e8f"}]'
-				value: []byte("[{\"op\":\"replace\",\"path\":\"/spec/template/spec/containers/0/image\", \"value\": \"123456789012.dkr.ecr.region.amazonaws.com/test2-frontend:bec0e8f\"}]"),
+				value: []byte(`[
+					{"op": "replace", "path": "/spec/template/spec/containers/0/image", "value": "123456789012.dkr.ecr.region.amazonaws.com/test2-frontend:5d1a9c2"},
+					{"op": "add", "path": "/metadata/annotations/ecr-tag.brilliantsolutions.com~1original-image", "value": "123456789012.dkr.ecr.region.amazonaws.com/test2-frontend:notlatest"},
+					{"op": "add", "path": "/metadata/annotations/ecr-tag.brilliantsolutions.com~1resolved-at", "value": "2020-03-07T05:30:00Z"},
+					{"op": "add", "path": "/metadata/annotations/ecr-tag.brilliantsolutions.com~1resolved-image", "value": "123456789012.dkr.ecr.region.amazonaws.com/test2-frontend:5d1a9c2"},
+					{"op": "add", "path": "/metadata/annotations/ecr-tag.brilliantsolutions.com~1tag-source", "value": "ssm"},
+					{"op": "add", "path": "/metadata/annotations/ecr-tag.brilliantsolutions.com~1tag-source-key", "value": "/test2/frontend/staging/ecr_tag"},
+					{"op": "add", "path": "/metadata/annotations/kubernetes.io~1change-cause", "value": "ecr-tag: set image 123456789012.dkr.ecr.region.amazonaws.com/test2-frontend:5d1a9c2 from /test2/frontend/staging/ecr_tag"},
+					{"op": "add", "path": "/spec/template/metadata/annotations", "value": {
+						"ecr-tag.brilliantsolutions.com/original-image": "123456789012.dkr.ecr.region.amazonaws.com/test2-frontend:notlatest",
+						"ecr-tag.brilliantsolutions.com/resolved-at": "2020-03-07T05:30:00Z",
+						"ecr-tag.brilliantsolutions.com/resolved-image": "123456789012.dkr.ecr.region.amazonaws.com/test2-frontend:5d1a9c2",
+						"ecr-tag.brilliantsolutions.com/tag-source": "ssm",
+						"ecr-tag.brilliantsolutions.com/tag-source-key": "/test2/frontend/staging/ecr_tag"
+					}}
+				]`),
 			},
 			status:  metav1.StatusSuccess,
 			wantErr: false,
 		},
+		{
+			name: "AWSUnavailableAllowedUnmodified",
+			args: args{
+				image:   "test2-frontend:notlatest",
+				repoErr: awserr.New("ThrottlingException", "rate exceeded", nil),
+				event:   eventWithImageInNamespace(req, previewNamespace, "123456789012.dkr.ecr.region.amazonaws.com/test2-frontend:notlatest"),
+			},
+			status:   metav1.StatusSuccess,
+			warnings: []string{"awsUnavailable: ThrottlingException: rate exceeded; allowing the deployment without updating its image"},
+		},
+		{
+			name: "AWSUnavailableDenied",
+			args: args{
+				image:   "test2-frontend:notlatest",
+				repoErr: awserr.New("ThrottlingException", "rate exceeded", nil),
+				event:   eventWithImage(req, "123456789012.dkr.ecr.region.amazonaws.com/test2-frontend:notlatest"),
+			},
+			status:  metav1.StatusFailure,
+			wantErr: true,
+			code:    http.StatusServiceUnavailable,
+		},
+		{
+			name: "AuditModeWouldPatch",
+			args: args{
+				image: "test2-frontend",
+				repo: &ecr.Repository{
+					RepositoryName:             aws.String("test2-frontend"),
+					ImageTagMutability:         aws.String(ecr.ImageTagMutabilityMutable),
+					ImageScanningConfiguration: &ecr.ImageScanningConfiguration{ScanOnPush: aws.Bool(false)},
+				},
+				parameterName: "/test2/frontend/ecr_tag",
+				parameter:     &ssm.Parameter{Name: aws.String("/test2/frontend/ecr_tag"), Value: aws.String("bec0e8f")},
+				event:         eventWithImageInNamespace(req, auditNamespace, "123456789012.dkr.ecr.region.amazonaws.com/test2-frontend:notlatest"),
+			},
+			status: metav1.StatusSuccess,
+			warnings: []string{
+				"container echo: would replace tag notlatest with bec0e8f, from /test2/frontend/ecr_tag",
+				"audit: the deployment would be patched with 8 operations, see the audit annotations",
+			},
+			audited: true,
+		},
+		{
+			name: "AuditModeWouldDeny",
+			args: args{
+				image:        "auth:notlatest",
+				repoNotFound: true,
+				event:        eventWithImageInNamespace(req, auditNamespace, "123456789012.dkr.ecr.region.amazonaws.com/auth:notlatest"),
+			},
+			status:   metav1.StatusSuccess,
+			warnings: []string{"audit: the deployment would be denied: RepositoryNotFoundException: repository not found"},
+			audited:  true,
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// ctx, cancel := context.WithCancel(context.Background())
-			// defer cancel()
-			// if tt.args.repo != nil {
-			// 	ecrSvc.On("DescribeRepositoriesWithContext",
-			// 		ctx,
-			// 		&ecr.DescribeRepositoriesInput{
-			// 			RepositoryNames: []*string{tt.args.repo.RepositoryName},
-			// 		},
-			// 	).Return(&ecr.DescribeRepositoriesOutput{Repositories: []*ecr.Repository{tt.args.repo}}, nil)
-			// }
+			ecrSvc := new(mockECRClient)
+			ssmSvc := new(mockSSMClient)
+			container := function.NewContainer(cfg, ecrSvc, ssmSvc)
+			container.Clock = func() time.Time { return resolvedAt }
+			app.Handler = container.Handler().WithLogging()
+
+			if tt.args.repo != nil {
+				ecrSvc.On("DescribeRepositoriesWithContext",
+					mock.Anything,
+					&ecr.DescribeRepositoriesInput{
+						RegistryId:      aws.String(registryID),
+						RepositoryNames: []*string{tt.args.repo.RepositoryName},
+					},
+				).Return(&ecr.DescribeRepositoriesOutput{Repositories: []*ecr.Repository{tt.args.repo}}, nil)
+			} else if tt.args.repoNotFound || tt.args.repoErr != nil {
+				repoErr := tt.args.repoErr
+				if repoErr == nil {
+					repoErr = awserr.New(ecr.ErrCodeRepositoryNotFoundException, "repository not found", nil)
+				}
+				ecrSvc.On("DescribeRepositoriesWithContext",
+					mock.Anything,
+					&ecr.DescribeRepositoriesInput{
+						RegistryId:      aws.String(registryID),
+						RepositoryNames: []*string{aws.String(strings.Split(tt.args.image, ":")[0])},
+					},
+				).Return(&ecr.DescribeRepositoriesOutput{}, repoErr)
+			}
+			if tt.args.parameterName != "" {
+				input := &ssm.GetParameterInput{Name: aws.String(tt.args.parameterName)}
+				if tt.args.parameter != nil {
+					ssmSvc.On("GetParameterWithContext", mock.Anything, input).Return(&ssm.GetParameterOutput{Parameter: tt.args.parameter}, nil)
+				} else {
+					ssmSvc.On("GetParameterWithContext", mock.Anything, input).Return(&ssm.GetParameterOutput{}, awserr.New(ssm.ErrCodeParameterNotFound, "parameter not found", nil))
+				}
+			}
 
 			// Deactivate those tests for now, until their code is activated
 			// if tt.args.shouldCheckVuln {
@@ -213,16 +427,160 @@ func TestHandler(t *testing.T) {
 			t.Logf("Got review body: %#+v", review)
 			require.Nil(t, err)
 			require.Equal(t, tt.status, review.Response.Result.Status)
-			if tt.wantErr {
+			if tt.wantErr && tt.code != 0 {
+				require.Equal(t, tt.code, review.Response.Result.Code)
+			} else if tt.wantErr {
 				require.GreaterOrEqual(t, review.Response.Result.Code, int32(400))
 				require.Less(t, review.Response.Result.Code, int32(500))
 			}
+			require.Equal(t, tt.warnings, review.Response.Warnings)
+			for key, value := range tt.annotations {
+				require.Equal(t, value, review.Response.AuditAnnotations[key], key)
+			}
+			if tt.audited {
+				require.True(t, review.Response.Allowed)
+				require.Equal(t, "audit", review.Response.AuditAnnotations["mode"])
+			}
 			if tt.status == metav1.StatusSuccess {
 				require.GreaterOrEqual(t, review.Response.Result.Code, int32(200))
 				require.Equal(t, review.Response.PatchType, tt.patch.patchType)
-				require.Equal(t, review.Response.Patch, tt.patch.value)
+				if tt.patch.value == nil {
+					require.Nil(t, review.Response.Patch)
+				} else {
+					require.JSONEq(t, string(tt.patch.value), string(review.Response.Patch))
+				}
 			}
 			ecrSvc.AssertExpectations(t)
+			ssmSvc.AssertExpectations(t)
+		})
+	}
+}
+
+func TestAdmissionDeadline(t *testing.T) {
+	cfg := config.Default()
+	tests := []struct {
+		name   string
+		query  string
+		budget time.Duration
+	}{
+		{"APIServerTimeout", "?timeout=5s", 4 * time.Second},
+		{"ConfiguredTimeout", "", 9 * time.Second},
+		{"TimeoutWithinHeadroom", "?timeout=1s", 500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var budget time.Duration
+			handler := func(ctx context.Context, r *http.Request) (*v1.AdmissionReview, error) {
+				deadline, _ := ctx.Deadline()
+				budget = time.Until(deadline)
+				return &v1.AdmissionReview{}, nil
+			}
+			app := api.NewApp(cfg, config.NewStaticPolicy(cfg.Policy), handler)
+			rec := httptest.NewRecorder()
+			api.BuildRouter(app).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/"+tt.query, nil))
+			require.Equal(t, http.StatusOK, rec.Code)
+			require.InDelta(t, tt.budget, budget, float64(100*time.Millisecond))
+		})
+	}
+}
+
+func TestAudit(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := dir + "/token"
+	require.NoError(t, os.WriteFile(tokenFile, []byte("s3cr3t\n"), 0600))
+	trail, err := audit.NewStore(dir+"/trail", 1<<20, 0)
+	require.NoError(t, err)
+	tuesday := time.Date(2020, 3, 3, 9, 0, 0, 0, time.UTC)
+	require.NoError(t, trail.Append(audit.Record{Time: tuesday, UID: "1", Namespace: stagingNamespace, Name: "gmt-backend", Outcome: "patched"}))
+	require.NoError(t, trail.Append(audit.Record{Time: tuesday.Add(24 * time.Hour), UID: "2", Namespace: stagingNamespace, Name: "gmt-backend", Outcome: "patched"}))
+
+	cfg := config.Default()
+	cfg.AuditTrail = config.AuditTrail{Dir: dir + "/trail", TokenFile: tokenFile}
+	app := api.NewApp(cfg, config.NewStaticPolicy(cfg.Policy), nil)
+	app.Audit = trail
+	s := httptest.NewServer(api.BuildRouter(app))
+	defer s.Close()
+
+	tests := []struct {
+		name   string
+		query  string
+		token  string
+		status int
+		uids   []string
+	}{
+		{"Unauthenticated", "", "", http.StatusUnauthorized, nil},
+		{"WrongToken", "", "other", http.StatusUnauthorized, nil},
+		{"All", "", "s3cr3t", http.StatusOK, []string{"1", "2"}},
+		{"LastTuesday", "?workload=gmt-backend&since=2020-03-03T00:00:00Z&until=2020-03-04T00:00:00Z", "s3cr3t", http.StatusOK, []string{"1"}},
+		{"InvalidTime", "?since=tuesday", "s3cr3t", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, s.URL+"/audit"+tt.query, nil)
+			require.NoError(t, err)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			res, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer res.Body.Close()
+			require.Equal(t, tt.status, res.StatusCode)
+			if tt.uids == nil {
+				return
+			}
+			var body struct{ Records []audit.Record }
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+			var uids []string
+			for _, r := range body.Records {
+				uids = append(uids, r.UID)
+			}
+			require.Equal(t, tt.uids, uids)
+		})
+	}
+}
+
+func TestAdminRouter(t *testing.T) {
+	cfg := config.Default()
+	policyFile := t.TempDir() + "/policy.yaml"
+	require.NoError(t, os.WriteFile(policyFile, []byte("namespaces:\n  deployment: develop\n"), 0600))
+	rejected, err := config.NewPolicyWatcher(policyFile, time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(policyFile, []byte("namespaces:\n  deployment: Not_A_Namespace\n"), 0600))
+	require.Error(t, rejected.Reload())
+	now := time.Now()
+	valid := &x509.Certificate{NotBefore: now.Add(-time.Hour), NotAfter: now.Add(time.Hour)}
+	expired := &x509.Certificate{NotBefore: now.Add(-2 * time.Hour), NotAfter: now.Add(-time.Hour)}
+	cold := func() error { return function.ErrNotWarmedUp }
+	noCredentials := func(context.Context) error { return errors.New("NoCredentialProviders: no valid providers in chain") }
+
+	tests := []struct {
+		name   string
+		path   string
+		app    func(app *api.App)
+		status int
+		body   string
+	}{
+		{"Healthy", "/healthz", func(*api.App) {}, http.StatusOK, `{"status":"ok"}`},
+		{"Version", "/version", func(*api.App) {}, http.StatusOK, `{"version":"dev"}`},
+		{"Ready", "/readyz", func(app *api.App) { app.Certificate = valid }, http.StatusOK,
+			`{"status":"ready","checks":{"certificate":"ok","policy":"ok"}}`},
+		{"CertificateNotLoaded", "/readyz", func(*api.App) {}, http.StatusServiceUnavailable,
+			`{"status":"not ready","checks":{"certificate":"not loaded","policy":"ok"}}`},
+		{"CertificateExpired", "/readyz", func(app *api.App) { app.Certificate = expired }, http.StatusServiceUnavailable,
+			`{"status":"not ready","checks":{"certificate":"expired on ` + expired.NotAfter.Format(time.RFC3339) + `","policy":"ok"}}`},
+		{"PolicyRejected", "/readyz", func(app *api.App) { app.Certificate, app.Policies = valid, rejected }, http.StatusServiceUnavailable,
+			`{"status":"not ready","checks":{"certificate":"ok","policy":` + strconv.Quote(rejected.Err().Error()) + `}}`},
+		{"NotWarmNorCredentials", "/readyz", func(app *api.App) { app.Certificate, app.Ready, app.Credentials = valid, cold, noCredentials }, http.StatusServiceUnavailable,
+			`{"status":"not ready","checks":{"certificate":"ok","policy":"ok","awsCredentials":"NoCredentialProviders: no valid providers in chain","cache":"` + function.ErrNotWarmedUp.Error() + `"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := api.NewApp(cfg, config.NewStaticPolicy(cfg.Policy), nil)
+			tt.app(app)
+			rec := httptest.NewRecorder()
+			api.BuildAdminRouter(app).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			require.Equal(t, tt.status, rec.Code)
+			require.JSONEq(t, tt.body, rec.Body.String())
 		})
 	}
 }
@@ -238,8 +596,11 @@ func eventWithBadRequest(req http.Request) http.Request {
 }
 
 func eventWithImage(req http.Request, image string) http.Request {
-	deploymentNamespace := os.Getenv("DEPLOYMENT_NAMESPACE")
-	req.Body = io.NopCloser(strings.NewReader(fmt.Sprintf(testdata.ReviewWithOneImage, deploymentNamespace, deploymentNamespace, image)))
+	return eventWithImageInNamespace(req, deploymentNamespace, image)
+}
+
+func eventWithImageInNamespace(req http.Request, namespace, image string) http.Request {
+	req.Body = io.NopCloser(strings.NewReader(fmt.Sprintf(testdata.ReviewWithOneImage, namespace, namespace, image)))
 	return req
 }
 